@@ -30,6 +30,7 @@ import (
 	"regexp"
 	"path"
 	"os"
+	"io"
 	"hash/fnv"
 	"time"
 	"math"
@@ -49,7 +50,7 @@ import (
 
 func PromiseContext_Begin(g Analytics, name string) PromiseContext {
 
-	before := time.Now()
+	before := CLOCK.Now()
 	return StampedPromiseContext_Begin(g, name, before)
 }
 
@@ -65,12 +66,24 @@ func StampedPromiseContext_Begin(g Analytics, name string, before time.Time) Pro
 
 	// *** begin ANTI-SPAM/DOS PROTECTION ***********
 
-	ifelapsed := int64(30)   // these params should be policy
-	expireafter := int64(60)
+	policy := GetPromisePolicy(name)
 
-	now := time.Now().UnixNano()
+	now := CLOCK.Now().UnixNano()
 
-	ctx.Plock = BeginService(name,ifelapsed,expireafter, now) 
+	if policy.Admission != nil {
+
+		ctx.Plock = AdmitService(g,ctx,name,*policy.Admission,now)
+
+	} else {
+
+		plock, err := BeginService(name,policy.IfElapsed,policy.ExpireAfter, now) 
+
+		if err != nil {
+			fmt.Println("Refusing service, lock failed:",err)
+		}
+
+		ctx.Plock = plock
+	}
 
 	// *** end ANTI-SPAM/DOS PROTECTION ***********
 
@@ -81,7 +94,7 @@ func StampedPromiseContext_Begin(g Analytics, name string, before time.Time) Pro
 
 func PromiseContext_End(g Analytics, ctx PromiseContext) PromiseHistory {
 
-	after := time.Now()
+	after := CLOCK.Now()
 	return StampedPromiseContext_End(g,ctx,after)
 }
 
@@ -91,14 +104,16 @@ func StampedPromiseContext_End(g Analytics, ctx PromiseContext, after time.Time)
 
 	before := ctx.Time
 
-	EndService(ctx.Plock)
+	if err := EndService(ctx.Plock); err != nil {
+		fmt.Println("Failed to release service lock:",err)
+	}
 
 	const collname = "conn"
 	var key string
 
-	// Semantic donut time key ..
+	// Semantic donut time key .. at the time the promise outcome was observed
 
-	_, timeslot := DoughNowt(time.Now())
+	_, timeslot := DoughNowt(after)
 	
 	if ctx.Name == "" {
 		key = timeslot
@@ -131,7 +146,19 @@ func StampedPromiseContext_End(g Analytics, ctx PromiseContext, after time.Time)
 
 	dtau := dt/db * b
 
-	e := LearnUpdateKeyValue(g,"BeginEndLocks",key,time.Now().UnixNano(),b,"ns")
+	policy := GetPromisePolicy(ctx.Name)
+
+	e := LearnUpdateKeyValueRate(g,"BeginEndLocks",key,after.UnixNano(),b,"ns",policy.HistoryRate)
+
+	// The weekly slot history keeps the long term tail, time windows the recent one
+
+	AddToSketchWindow(g,ctx.Name,after.UnixNano(),b)
+
+	RaiseAnomalyContexts("latency",e.Anomalies)
+
+	for _,ev := range e.Anomalies {
+		Println("   Latency anomaly",ev.Detector,ev.Direction,"magnitude (sigma)",ev.Magnitude,"since",time.Unix(0,ev.Onset))
+	}
 
 	var lastlatency,lasttime KeyValue
 
@@ -166,16 +193,67 @@ func StampedPromiseContext_End(g Analytics, ctx PromiseContext, after time.Time)
 
 func AssessPromiseOutcome(g Analytics, e PromiseHistory, assessed_quality,promise_upper_bound,trust_interval float64) float64 {
 
-	promised_ns := promise_upper_bound * NANO
-	trust_ns := trust_interval * NANO
-
-	key := e.PromiseId
-
 	// This function decides the kinetic trust and adjusts the potential
 	// V based on real time promise keeping. It doesn't consider the initial
 	// determination of V -- i.e. whether we want to talk to the other agent
 	// at all (as in security)
 
+	key := e.PromiseId
+	policy := GetPromisePolicy(key)
+
+	// A tail promise is about how the promise is kept now, not since records began
+
+	if policy.Quantile != "" {
+		now := e.T / NANO
+		e.Recent = GetWindowSketch(g,PromiseNameOf(key),now - SKETCH_RECENT,now)
+	}
+
+	// Get our previous estimate of reliability
+
+	reliability := GetKV(g,"PromiseKeeping",key)
+
+	fmt.Println("Old ML running reliability(delta)",reliability.V)
+
+	var promise_level float64
+
+	reliability.K = key
+	reliability.V,promise_level = UpdateReliability(os.Stdout,reliability.V,e,assessed_quality,promise_upper_bound,trust_interval,policy)
+	reliability.V = ApplyTrustOffset(key,reliability.V)
+
+	fmt.Println("Promise level",promise_level,"raw",e.Q/NANO,promise_upper_bound)
+	fmt.Println("New ML running reliability(delta)",reliability.V)
+
+	AddKV(g,"PromiseKeeping",reliability)
+
+	// Count the outcome against the error budget, if the promise has an SLO
+
+	if policy.Objective > 0 {
+
+		kept := promise_level >= BUDGET_KEPT_LEVEL && assessed_quality >= ASSESS_PAR
+
+		RecordPromiseKept(g,PromiseNameOf(key),e.T,kept)
+		AssessErrorBudget(g,key,e.T)
+	}
+
+	return reliability.V
+}
+
+// **********************************************************************
+
+func UpdateReliability(w io.Writer, previous float64, e PromiseHistory, assessed_quality,promise_upper_bound,trust_interval float64, policy PromisePolicy) (float64,float64) {
+
+	// The assessment itself, given the previous reliability (0 = none yet),
+	// returning the new reliability and the promise level of this outcome.
+	// Nothing is stored, so observers can keep their own state (simulation),
+	// and the running commentary goes to w, which they may discard
+
+	promised_ns := promise_upper_bound * NANO
+	trust_ns := trust_interval * NANO
+
+	decay := PolicyDecay(policy)
+	reliability := previous
+	unobserved := UnobservedInterval(e,decay)
+
 	var sig float64 = math.Sqrt(e.Q_var)
 
 	// Here we've measured the timing and we've looked at the content
@@ -184,33 +262,50 @@ func AssessPromiseOutcome(g Analytics, e PromiseHistory, assessed_quality,promis
 
 	// The trouble is that we don't usually know what was promised...
 
-	promise_level := 1/(1+math.Exp(3*(e.Q-promised_ns)/promised_ns))
+	promise_level := PromiseLevel(e.Q,promised_ns,OUTCOME_AT_MOST)
+
+	// If the promise is about the tail, e.g. "p99 < 1.6s", assess that instead
 
-	fmt.Println("Promise level",promise_level,"+-",sig/promised_ns,"raw",e.Q/NANO,promise_upper_bound)
+	if policy.Quantile != "" {
+
+		qb,err := ParseQuantilePromise(policy.Quantile)
+
+		if err != nil {
+			fmt.Println("Ignoring quantile policy:",err)
+		} else if e.Recent.Total > 0 {
+			promise_level = QuantilePromiseLevel(e.Recent,qb)
+			fmt.Fprintln(w,"Quantile promise",qb.Spec,"observed",SketchQuantile(e.Recent,qb.Quantile)/NANO,"s")
+		}
+	}
+
+	fmt.Fprintln(w,"Promise level",promise_level,"+-",sig/promised_ns,"raw",e.Q/NANO,promise_upper_bound)
 
 	if e.Dt_av == 0 {
 		e.Dt_av = 1.0
 	}
 
-	fmt.Println("Assessing expected sampling interval",float64(e.T)/e.Dt_av)
-	fmt.Println("Assessing desired sampling interval",float64(e.T)/trust_ns)
+	fmt.Fprintln(w,"Assessing expected sampling interval",float64(e.T)/e.Dt_av)
+	fmt.Fprintln(w,"Assessing desired sampling interval",float64(e.T)/trust_ns)
 
 	// The assessed payload is the user defined arbitrary up or downvote
 	// How well did we keep our promise payload?
 
-	fmt.Println("Assessing expected Q level",float64(e.Q)/e.Q_av)
-	fmt.Println("Assessing desired Q level",float64(e.Q)/promised_ns)
-	fmt.Println("Assessing payload",assessed_quality)
+	fmt.Fprintln(w,"Assessing expected Q level",float64(e.Q)/e.Q_av)
+	fmt.Fprintln(w,"Assessing desired Q level",float64(e.Q)/promised_ns)
+	fmt.Fprintln(w,"Assessing payload",assessed_quality)
 
-	fmt.Println("Assessing level change",(e.Q-e.Q1)/promised_ns)
+	fmt.Fprintln(w,"Assessing level change",(e.Q-e.Q1)/promised_ns)
 
-	// Get our previous estimate of reliability
+	if reliability == 0 {
 
-	reliability := GetKV(g,"PromiseKeeping",key)
+		reliability = decay.Prior // Start evens
+
+	} else if unobserved > 0 {
 
-	if reliability.V == 0 {
+		// Old evidence fades toward the prior over any gap in sampling
 
-		reliability.V = 0.5 // Start evens
+		reliability = RelaxReliability(reliability,unobserved,e,decay)
+		fmt.Fprintln(w,"Reliability relaxed over unobserved interval",reliability)
 	}
 
 	// Q is always positive (latency here...)
@@ -221,7 +316,7 @@ func AssessPromiseOutcome(g Analytics, e PromiseHistory, assessed_quality,promis
 
 	if math.Abs(e.Q_av) < sig {  // Down vote for noisy behaviour
 
-		fmt.Println("1.PENALTY!")
+		fmt.Fprintln(w,"1.PENALTY!")
 		delta = delta / 1.5
 	}
 
@@ -231,24 +326,27 @@ func AssessPromiseOutcome(g Analytics, e PromiseHistory, assessed_quality,promis
 	dqdt := FirstDerivative(e,promised_ns,trust_ns)
 	d2qdt2 := SecondDerivative(e,promised_ns,trust_ns)
 
+	fmt.Fprintln(w,"Deriv dq/dt (latency)",dqdt)
+	fmt.Fprintln(w,"Deriv d2q/dt2 (latency)",d2qdt2)
+
 	const sensitivity = 0.01 // should this be the same for 1st and second?
 
 	if dqdt < -sensitivity {
-		fmt.Println("Gradient reducing (spot measure)")
+		fmt.Fprintln(w,"Gradient reducing (spot measure)")
 		delta = delta + 0.1
 	} else if dqdt > sensitivity {
-		fmt.Println("Gradient increasing (spot measure)")
+		fmt.Fprintln(w,"Gradient increasing (spot measure)")
 		delta = delta - 0.1
-		fmt.Println("2.PENALTY!")
+		fmt.Fprintln(w,"2.PENALTY!")
 	}
 
 	if d2qdt2 < -sensitivity {
-		fmt.Println("Curvature decelerating (positive force)")
+		fmt.Fprintln(w,"Curvature decelerating (positive force)")
 		delta = delta + 0.1
 	} else if d2qdt2 > sensitivity {
-		fmt.Println("Curvature accelerating (negative force)")
+		fmt.Fprintln(w,"Curvature accelerating (negative force)")
 		delta = delta - 0.1
-		fmt.Println("3.PENALTY!")
+		fmt.Fprintln(w,"3.PENALTY!")
 	}
 
 	//if math.Fabs(SecondDeriv(e)) > SCALE {
@@ -257,22 +355,16 @@ func AssessPromiseOutcome(g Analytics, e PromiseHistory, assessed_quality,promis
 
 	// Adjust reliability according to timing AND quality
 
-	fmt.Println("Old ML running reliability(delta)",reliability.V)
-
 	if delta < 0 {
 
 		delta = 0
 	}
 
+	reliability = reliability * (1 - policy.LearningRate) + delta * policy.LearningRate
 
-	reliability.K = key
-	reliability.V = reliability.V * 0.4 + delta * 0.6
-
-	fmt.Println("New ML running reliability(delta)",reliability.V,delta)
+	fmt.Fprintln(w,"Reliability delta",delta)
 
-	AddKV(g,"PromiseKeeping",reliability)
-
-	return reliability.V
+	return reliability, promise_level
 }
 
 // ***************************************************************************
@@ -281,15 +373,18 @@ func AssessPromiseOutcome(g Analytics, e PromiseHistory, assessed_quality,promis
 //
 // ***************************************************************************
 
-func TextPrism(subject, mainpage string, paragraph_radius int) [MAXCLUSTERS]map[string]float64 {
+func TextPrism(subject, mainpage string, paragraph_radius int) PrismResult {
+
+	// See FractionatorTextPrism for an independent instance. The result's
+	// Ngrams are the longitudinally persistent concepts, by n
 
 	LEG_WINDOW = paragraph_radius
-	LEG_SELECTIONS = make([]string,0)
 
-	selected,ltm := FractionateSentences(mainpage)
-	ReviewAndSelectEvents(subject,selected)		
-	pagetopics := RankByIntent(selected,ltm)
-	return LongitudinalPersistentConcepts(pagetopics)
+	f := DefaultFractionator()
+	result := FractionatorTextPrism(f,subject,mainpage)
+	SaveDefaultFractionator(f)
+
+	return result
 }
 
 // ***************************************************************************
@@ -319,37 +414,25 @@ type SemanticLinkSet map[string][]ConnectionSemantics
 // Heuristic context, CFEngine style
 // ****************************************************************************
 
-var CONTEXT map[string]float64
-
-// *******************************************************************************
+// The default store is TT.CONTEXT, see context_store.go
 
 func ContextAdd(s string) {
 
-	CONTEXT[s]++
+	ContextStoreAdd(CONTEXT,s,CLOCK.Now().UnixNano())
 }
 
 // *******************************************************************************
 
 func ContextSet() []string {
 
-	var result []string
-
-	for s := range CONTEXT {
-		if CONTEXT[s] > 0 {
-			result = append(result,s)
-		}
-	}
-
-	sort.Strings(result)
-
-	return result
+	return ContextStoreSet(CONTEXT,CLOCK.Now().UnixNano())
 }
 
 // *******************************************************************************
 
 func InitializeContext() {
 
-	CONTEXT = make(map[string]float64)
+	ContextStoreReset(CONTEXT)
 }
 
 // *******************************************************************************
@@ -414,6 +497,16 @@ type PromiseHistory struct {
 	AntiT     float64    `json:"antiT"`
 
 	Units     string     `json:"units"`
+
+	// Tail behaviour, which the averages can't express
+
+	Sketch    QuantileSketch `json:"sketch"`
+	Recent    QuantileSketch `json:"-"`  // the last SKETCH_RECENT seconds, to assess quantile promises
+
+	// Change-point detector state, and any anomalies found by the last update
+
+	Detectors DetectorState  `json:"detectors"`
+	Anomalies []AnomalyEvent `json:"-"`
 }
 
 // ****************************************************************************
@@ -514,6 +607,9 @@ const FORGET_FRACTION = 0.001    // this amount per sentence ~ forget over 1000
 
 const LOWEST_INTENT_CUTOFF = 0.3 // cutoff for keeping n-grams, measured in intent
 const MINIMUM_FREQ_CUTOFF = 3    //         "                 , measured in occurrences
+const MINIMUM_WORK = 5           //         "                 , measured in work (see WorkMeasure)
+const MIN_RECURRENCE = 3         // topics recur on average further apart than this (sentences)
+const MAX_RECURRENCE_LEGS = 4    //   and closer than this (legs)
 const MIN_LEGAL_KEYNAME = 3
 
 // ****************************************************************************
@@ -1339,6 +1435,36 @@ func LearnUpdateKeyValue(g Analytics, coll_name, key string, now int64, q float6
 
 	// now should be time.Now().UnixNano()
 
+	return LearnUpdateKeyValueRate(g,coll_name,key,now,q,units,0.5)
+}
+
+// **************************************************
+
+func LearnUpdateKeyValueRate(g Analytics, coll_name, key string, now int64, q float64, units string, rate float64) PromiseHistory {
+
+	// As LearnUpdateKeyValue, with the weight of the new sample in the running
+	// averages given by rate (policy history_rate) instead of the 50/50 default
+
+	exists, previous,coll := GetPromiseHistory(g,coll_name,key)
+
+	e := NextPromiseHistory(previous,exists,key,now,q,units,rate)
+
+	if !exists {
+		AddPromiseHistory(g, coll, coll_name, e)
+	} else {
+		UpdatePromiseHistory(g, coll_name, key, e)
+	}
+
+	return e
+}
+
+// **************************************************
+
+func NextPromiseHistory(previous PromiseHistory, exists bool, key string, now int64, q float64, units string, rate float64) PromiseHistory {
+
+	// The learning step itself, without storage, so that it can also be
+	// used by observers that keep their histories in memory (simulation)
+
 	var e PromiseHistory
 
 	e.PromiseId = key
@@ -1347,8 +1473,6 @@ func LearnUpdateKeyValue(g Analytics, coll_name, key string, now int64, q float6
 
 	// time is weird in go. Duration is basically int64 in nanoseconds
 
-	exists, previous,coll := GetPromiseHistory(g,coll_name,key)
-	
 	if !exists {
 
 		// Initial bootstrap defaults
@@ -1360,7 +1484,10 @@ func LearnUpdateKeyValue(g Analytics, coll_name, key string, now int64, q float6
 		e.Dt_av = 0
 		e.Dt_var = 0
 
-		AddPromiseHistory(g, coll, coll_name, e)
+		e.Sketch = NewQuantileSketch()
+		SketchAdd(&e.Sketch,q)
+
+		e.Detectors,_ = DetectAnomalies(e.Detectors,key,now,q,ANOMALY_DETECTION)
 
 	} else {
 		e.Q2 = previous.Q1
@@ -1369,9 +1496,9 @@ func LearnUpdateKeyValue(g Analytics, coll_name, key string, now int64, q float6
 
 		e.Units = units
 
-		e.Q_av = 0.5 * previous.Q + 0.5 * float64(q)
+		e.Q_av = (1 - rate) * previous.Q + rate * float64(q)
 		dv2 := (e.Q-e.Q_av) * (e.Q-e.Q_av)
-		e.Q_var = 0.5 * e.Q_var + 0.5 * dv2
+		e.Q_var = (1 - rate) * e.Q_var + rate * dv2
 		
 		e.T2 = previous.T1
 		e.T1 = previous.T
@@ -1379,22 +1506,27 @@ func LearnUpdateKeyValue(g Analytics, coll_name, key string, now int64, q float6
 
 		dt := float64(now-previous.T) // time difference now-previous
 
-		e.Dt_av = 0.5 * previous.Dt_av + 0.5 * dt
-		e.Dt_var = 0.5 * e.Q_var + 0.5 * (e.Dt_av-dt) * (e.Dt_av-dt)
+		e.Dt_av = (1 - rate) * previous.Dt_av + rate * dt
+		e.Dt_var = (1 - rate) * e.Q_var + rate * (e.Dt_av-dt) * (e.Dt_av-dt)
 
-		UpdatePromiseHistory(g, coll_name, key, e)
+		e.Sketch = previous.Sketch
+		SketchAdd(&e.Sketch,q)
+
+		e.Detectors,e.Anomalies = DetectAnomalies(previous.Detectors,key,now,q,ANOMALY_DETECTION)
 	}
 
-return e
+	return e
 }
 
 // **************************************************
 
 func UpdatePromiseHistory(g Analytics, coll_name, key string, e PromiseHistory) {
 
-	querystring := fmt.Sprintf("LET doc = DOCUMENT(\"%s/%s\")\nUPDATE doc WITH { q: %f, q1: %f, q2: %f , q_av: %f, q_var: %f, lastT: %d, lastT1: %d,lastT22: %d, dT: %f, dT_var: %f } IN %s", coll_name,e.PromiseId,e.Q,e.Q1,e.Q2,e.Q_av,e.Q_var,e.T,e.T1,e.T2,e.Dt_av,e.Dt_var,coll_name)
+	querystring := fmt.Sprintf("LET doc = DOCUMENT(\"%s/%s\")\nUPDATE doc WITH { q: %f, q1: %f, q2: %f , q_av: %f, q_var: %f, lastT: %d, lastT1: %d,lastT22: %d, dT: %f, dT_var: %f, sketch: @sketch, detectors: @detectors } IN %s", coll_name,e.PromiseId,e.Q,e.Q1,e.Q2,e.Q_av,e.Q_var,e.T,e.T1,e.T2,e.Dt_av,e.Dt_var,coll_name)
+
+	bind := map[string]interface{}{ "sketch": e.Sketch, "detectors": e.Detectors }
 
-	cursor,err := g.S_db.Query(nil,querystring,nil)
+	cursor,err := g.S_db.Query(nil,querystring,bind)
 
 	if err != nil {
 		fmt.Printf("Query \""+ querystring +"\" failed: %v", err)
@@ -2455,8 +2587,6 @@ func FirstDerivative(e PromiseHistory, qscale,tscale float64) float64 {
 
 	dqdt := dq/dt
 
-	fmt.Println("Deriv dq/dt (latency)",dqdt)
-
 	return dqdt
 }
 
@@ -2474,8 +2604,6 @@ func SecondDerivative(e PromiseHistory, qscale,tscale float64) float64 {
 		return 0
 	}
 
-	fmt.Println("Deriv d2q/dt2 (latency)",d2qdt2)
-
 	return d2qdt2
 }
 
@@ -2773,30 +2901,56 @@ func DoughNowt(then time.Time) (string,string) {
 	// Return a db-suitable keyname reflecting the coarse-grained SST time
 	// The function also returns a printable summary of the time
 
-	year := fmt.Sprintf("Yr%d",then.Year())
-	month := GR_MONTH_TEXT[int(then.Month())-1]
-	day := then.Day()
-	hour := fmt.Sprintf("Hr%02d",then.Hour())
-	mins := fmt.Sprintf("Min%02d",then.Minute())
-	quarter := fmt.Sprintf("Q%d",then.Minute()/15 + 1)
-	shift :=  fmt.Sprintf("%s",GR_SHIFT_TEXT[then.Hour()/6])
+	t := DoughNowtParts(then)
 
-	//secs := then.Second()
-	//nano := then.Nanosecond()
+	var when string = fmt.Sprintf("%s,%s,%s,%s,%s at %s %s %s %s",t.Shift,t.Weekday,t.Day,t.Month,t.Year,t.Hour,t.Mins,t.Quarter,t.Interval)
+	var key string = fmt.Sprintf("%s:%s:%s",t.Dow,t.Hour,t.Interval)
 
-	dayname := then.Weekday()
-	dow := fmt.Sprintf("%.3s",dayname)
-	daynum := fmt.Sprintf("Day%d",day)
+	return when, key
+}
 
-	// 5 minute resolution capture
-        interval_start := (then.Minute() / 5) * 5
-        interval_end := (interval_start + 5) % 60
-        minD := fmt.Sprintf("Min%02d_%02d",interval_start,interval_end)
+// ****************************************************************************
 
-	var when string = fmt.Sprintf("%s,%s,%s,%s,%s at %s %s %s %s",shift,dayname,daynum,month,year,hour,mins,quarter,minD)
-	var key string = fmt.Sprintf("%s:%s:%s",dow,hour,minD)
+type TimeParts struct {
 
-	return when, key
+	Year     string  // Yr2023
+	Month    string  // January
+	Day      string  // Day19
+	Weekday  string  // Monday
+	Dow      string  // Mon
+	Hour     string  // Hr13
+	Mins     string  // Min05
+	Quarter  string  // Q1 (of the hour)
+	Shift    string  // Night, Morning, Afternoon, Evening
+	Interval string  // Min05_10
+}
+
+// ****************************************************************************
+
+func DoughNowtParts(then time.Time) TimeParts {
+
+	// The coarse grained parts of a time, as CFEngine names them, in
+	// the time's own location
+
+	var t TimeParts
+
+	t.Year = fmt.Sprintf("Yr%d",then.Year())
+	t.Month = GR_MONTH_TEXT[int(then.Month())-1]
+	t.Day = fmt.Sprintf("Day%d",then.Day())
+	t.Hour = fmt.Sprintf("Hr%02d",then.Hour())
+	t.Mins = fmt.Sprintf("Min%02d",then.Minute())
+	t.Quarter = fmt.Sprintf("Q%d",then.Minute()/15 + 1)
+	t.Shift = GR_SHIFT_TEXT[then.Hour()/6]
+
+	t.Weekday = then.Weekday().String()
+	t.Dow = fmt.Sprintf("%.3s",t.Weekday)
+
+	// 5 minute resolution capture
+	interval_start := (then.Minute() / 5) * 5
+	interval_end := (interval_start + 5) % 60
+	t.Interval = fmt.Sprintf("Min%02d_%02d",interval_start,interval_end)
+
+	return t
 }
 
 // ****************************************************************************
@@ -2900,35 +3054,40 @@ func ReadAndCleanFile(filename string) string {
 
 	content, _ := ioutil.ReadFile(filename)
 
-	// Start by stripping HTML / XML tags before para-split
-	// if they haven't been removed already
+	return CleanText(string(content))
+}
+
+// *****************************************************************
+
+func CleanText(content string) string {
 
-	m1 := regexp.MustCompile("<[^>]*>") 
-	stripped1 := m1.ReplaceAllString(string(content),"") 
+	// As ReadAndCleanFile, for text already in memory, e.g. from a stream.
+	// Any script is kept, see NormalizeText
 
-	//Strip and \begin \latex type commands
+	return CleanTextFor(content,nil)
+}
 
-	m2 := regexp.MustCompile("\\\\[^ –\n]+") 
-	stripped2 := m2.ReplaceAllString(stripped1," ") 
+// *****************************************************************
 
-	// Non-English alphabet (tricky), but leave ?!:;
+func CleanTextFor(content string, pack *LanguagePack) string {
 
-	m3 := regexp.MustCompile("[–{&}““”#%^+_#”=$’~‘/<>\"&]*") 
-	stripped3 := m3.ReplaceAllString(stripped2,"") 
+	// As CleanText, with a language pack's terminators, and sentences
+	// segmented by rules with its abbreviations
 
-	m4 := regexp.MustCompile("[:;]+")
-	stripped4 := m4.ReplaceAllString(stripped3,".")
+	return CleanTextWith(content,pack,DefaultSegmenter(pack))
+}
+
+// *****************************************************************
 
-	m5 := regexp.MustCompile("([^.,: ][\n])+")
-	stripped5 := m5.ReplaceAllString(stripped4,"$0:")
+func CleanTextWith(content string, pack *LanguagePack, seg Segmenter) string {
 
-	m6 := regexp.MustCompile("[^- a-zA-ZåøæÅØÆ.:,()!?\n]*")
-	stripped6 := m6.ReplaceAllString(stripped5,"")
+	// As CleanTextFor, with a choice of segmenter
+
+	normalized := NormalizeTextFor(content,pack)
 
 	// Encode end of sentence markers with a # for later splitting
 
-	m7 := regexp.MustCompile("[?!.]+")
-	mark := m7.ReplaceAllString(stripped6,"$0#")
+	mark := MarkSentenceEnds(normalized,seg,pack)
 
 	m8 := regexp.MustCompile("[ \n]+")
 	cleaned := m8.ReplaceAllString(mark," ")
@@ -2944,18 +3103,16 @@ func HashcodeSentenceSplit(str string) string {
 	// with hash markers. This is extracted from and duplicated 
 	// in ReadAndCleanFile() which preceded this helper.
 
-	var new string = ""
+	var new strings.Builder
 
 	for i := 0; i < len(str); i++ {
 
-		new += string(str[i])
+		new.WriteByte(str[i])
 
 		switch str[i] {
-		case '.':
-		case '!':
-		case '?':
+		case '.', '!', '?':
 			if (i < len(str)-1 && str[i+1] == ' ') {
-				new += "#"
+				new.WriteString("#")
 			}
 
 		default:
@@ -2963,9 +3120,9 @@ func HashcodeSentenceSplit(str string) string {
 		}
 	}
 
-	new += " "
+	new.WriteString(" ")
 
-	return new
+	return new.String()
 }
 
 // ***********************************************************
@@ -2976,26 +3133,9 @@ func FractionateText2Ngrams(text string) [MAXCLUSTERS]map[string]float64 {
 	// taking n-gram intentionality measures from the STM_NGRAM_RANK
 	// cumulative cross learning map. Raw, no sub-selection of text.
 
-	var ngrams [MAXCLUSTERS]map[string]float64
-
-	difftext_2 := strings.ReplaceAll(text,"\n","")
-	difftext_1 := strings.ReplaceAll(difftext_2,"[","")
-	difftext_0 := strings.ReplaceAll(difftext_1,"]","")
-
-	search := "\\[[0-9]+"
-
-	r := regexp.MustCompile(search)
-	tmp := r.ReplaceAllString(difftext_0,"")
-	cleantext := strings.TrimSpace(tmp)
-	_,ltm := FractionateSentences(cleantext)
-
-	for n := 1; n < MAXCLUSTERS; n++ {
-		ngrams[n] = make(map[string]float64)
-
-		for t := range ltm[n] {
-			ngrams[n][t] = STM_NGRAM_RANK[n][t]
-		}
-	}
+	f := DefaultFractionator()
+	ngrams := FractionatorText2Ngrams(f,text)
+	SaveDefaultFractionator(f)
 
 	return ngrams
 }
@@ -3004,51 +3144,14 @@ func FractionateText2Ngrams(text string) [MAXCLUSTERS]map[string]float64 {
 
 func FractionateSentences(text string) ([]Narrative,[MAXCLUSTERS]map[string][]int) {
 
-	// Take a text as a single string and break into sentences.
-	// Return a time series of sub-selected Narrative structures of the highest
-	// Intentionality sentences (most "suspicious" or highest effort)
-	// along with an ltm (long term memory) frequency map of every occurrence
-	// by sentence number
-
-	var sentences []string
-	var selected_sentences []Narrative
-	var ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int
-
-	for i := 1; i < MAXCLUSTERS; i++ {
-		ltm_every_ngram_occurrence[i] = make(map[string][]int)
-	} 
-
-	if len(text) == 0 {
-		return selected_sentences, ltm_every_ngram_occurrence
-	}
-
-	sentences = SplitIntoSentences(text)
-
-	var meaning = make([]float64,len(sentences))
-
-	for s_idx := range sentences {
-
-		meaning[s_idx] = FractionateThenRankSentence(s_idx,sentences[s_idx],len(sentences),ltm_every_ngram_occurrence)
-	}
-
-	// Some things to note: importance tends to be clustered around the start and the end of
-	// a story. The start is automatically weakner in this method, due to lack of data. We can
-	// compensate by weighting the start and the end by sentence number.
+	// Take a text as a single string and break into sentences, with the
+	// default fractionator (see FractionatorSentences)
 
-	midway := len(sentences) / 2
+	f := DefaultFractionator()
+	selected,ltm := FractionatorSentences(f,text)
+	SaveDefaultFractionator(f)
 
-	for s_idx := range sentences {
-
-		scale_factor := 1.0 + float64((midway - s_idx) * (midway - s_idx)) / float64(midway*midway)
-
-		n := NarrationMarker(sentences[s_idx], meaning[s_idx] * scale_factor, s_idx)
-			
-		selected_sentences = append(selected_sentences,n)
-		
-		ALL_SENTENCE_INDEX++
-	}
-
-	return selected_sentences, ltm_every_ngram_occurrence
+	return selected,ltm
 }
 
 //**************************************************************
@@ -3079,129 +3182,21 @@ func SplitIntoSentences(text string) []string {
 
 func FractionateThenRankSentence(s_idx int, sentence string, total_sentences int,ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int) float64 {
 
-	// A round robin cyclic buffer for taking fragments and extracting
-	// n-ngrams of 1,2,3,4,5,6 words separateed by whitespace, passing
+	f := DefaultFractionator()
+	rank := FractionatorRankSentence(f,s_idx,sentence,total_sentences,ltm_every_ngram_occurrence)
+	SaveDefaultFractionator(f)
 
-	var rrbuffer [MAXCLUSTERS][]string
-	var sentence_meaning_rank float64 = 0
-	var rank float64
-	
-	// split sentence on any residual punctuation here, because punctuation cannot be in the middle
-	// of an n-gram by definition of punctuation's promises, and we are not interested in word groups
-	// that unintentionally straddle punctuation markers, since they are false signals
-	
-	re := regexp.MustCompile("[,.;:!?]")
-	sentence_frags := re.Split(sentence, -1)
-	
-	for f := range sentence_frags {
-		
-		// For one sentence, break it up into codons and sum their importances
-		
-		clean_sentence := strings.Split(string(sentence_frags[f])," ")
-		
-		for word := range clean_sentence {
-			
-			// This will be too strong in general - ligatures and foreign languages etc
-			
-			m := regexp.MustCompile("[/()?!]*") 
-			cleanjunk := m.ReplaceAllString(clean_sentence[word],"") 
-			cleanword := strings.Trim(strings.ToLower(cleanjunk)," ")
-			
-			if len(cleanword) == 0 {
-				continue
-			}
-			
-			// Shift all the rolling longitudinal Ngram rr-buffers by one word
-			
-			rank, rrbuffer = NextWordAndUpdateLTMNgrams(s_idx,cleanword, rrbuffer,total_sentences,ltm_every_ngram_occurrence)
-			sentence_meaning_rank += rank
-		}
-	}
-	
-	return sentence_meaning_rank
+	return rank
 }
 
 //**************************************************************
 
 func RankByIntent(selected_sentences []Narrative,ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int) map[string]float64 {
 
-	// Analyse the sub-selected narrative array structure and select phrases with
-	// top ranking intentionality, looking for a radius of repetition in the text
-	// as a sign of longitudinal persistence of concept. This assumes that phrases
-	// that are repeated in clusters throughout a text will be associated with concepts
-	// important to the text, i.e. strongly intended meaning in terms of work done
+	// Select phrases with top ranking intentionality, with the default
+	// fractionator (see FractionatorRankByIntent)
 
-	var topics = make(map[string]float64)
-	sentences := len(selected_sentences)
-	
-	for n := 1; n < MAXCLUSTERS; n++ {
-		
-		var last,delta int
-
-		// Search through all sentence ngrams and measure distance between repeated
-		// try to indentify any scales that emerge
-
-		for ngram := range ltm_every_ngram_occurrence[n] {
-
-			occurrences := len(ltm_every_ngram_occurrence[n][ngram])
-
-			intent := Intentionality(n,ngram,sentences)
-
-			if intent < LOWEST_INTENT_CUTOFF  {
-				continue
-			}
-
-			last = 0
-
-			var min_delta int = 9999
-			var max_delta int = 0
-			var sum_delta int = 0
-
-			for location := 0; location < occurrences; location++ {
-
-				// Foreach occurrence, check proximity to others
-				// This is about seeing if an ngram is a recurring input in the stream.
-				// Does the subject recur several times over some scale? The scale may be
-				// logarithmic like n / log (o1-o2) for occurrence separation
-				// Radius = 100 sentences, how many occurrences of this ngram close together?
-				
-				// Does meaning have an intrinsic radius? It doesn't make sense that it
-				// depends on the length of the document. How could we measure this?	
-				
-				// two one relative to first occurrence (absolute range), one to last occurrence??
-				// only the last is invariant on the scale of a story
-				
-				delta = ltm_every_ngram_occurrence[n][ngram][location] - last			
-				last = ltm_every_ngram_occurrence[n][ngram][location]
-
-				sum_delta += delta
-
-				if min_delta > delta {
-					min_delta = delta
-				}
-
-				if max_delta < delta {
-					max_delta = delta
-				}
-			}
-			// which ngrams occur in bursty clusters. If completely even, then significance
-			// is low or the theme of the whole piece. If cluster span/total span
-			// max interdistance >> min interdistance then bursty
-			
-			if min_delta == 0 {
-				continue
-			}
-
-			av_delta := float64(sum_delta)/float64(occurrences)
-			
-			if (av_delta > 3) && (av_delta < float64(LEG_WINDOW) * 4) {
-				
-				topics[ngram] = intent
-			}
-		}
-	}
-	
-	return topics
+	return FractionatorRankByIntent(DefaultFractionator(),selected_sentences,ltm_every_ngram_occurrence)
 }
 
 // *****************************************************************
@@ -3238,7 +3233,11 @@ func LongitudinalPersistentConcepts(topics map[string]float64) [MAXCLUSTERS]map[
 
 	for i := 0; i < len(sortable); i++ {
 
-		n := strings.Count(sortable[i].Key," ") + 1
+		n := NgramLength(sortable[i].Key)
+
+		if n >= MAXCLUSTERS {
+			continue
+		}
 
 		invariants[n][sortable[i].Key] = sortable[i].Score
 
@@ -3252,114 +3251,12 @@ func LongitudinalPersistentConcepts(topics map[string]float64) [MAXCLUSTERS]map[
 	
 func ReviewAndSelectEvents(filename string, selected_sentences []Narrative) {
 
-	// The importances have now all been measured in realtime, but we review them now...posthoc
-	// Now go through the history map chronologically, by sentence only reset the narrative  
-        // `leg' counter when it fills up to measure story progress. 
-	// This determines the sampling density of "important sentences" - pick a few from each leg
-
-	Println(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>")
-	Println("> Select inferred intentional content summary ...about",filename)
-	Println(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>")
-
-	var steps,leg int
-
-	// Sentences to summarize per leg of the story journey
-
-	steps = 0
-
-	// We rank a leg by summing its sentence ranks
-
-	var rank_sum float64 = 0
-	var av_rank_for_leg []float64
-	
-	// First, coarse grain the narrative into `legs', 
-        // i.e. standardized "narrative regions" by meter not syntax
-
-	for s := range selected_sentences {
-
-		// Make list of summed importance ranks for each leg
+	// Pick a few important sentences from each leg, with the default
+	// fractionator (see FractionatorReviewAndSelectEvents)
 
-		rank_sum += selected_sentences[s].rank
-
-		// Once we've summed all the importances and reached the end of the leg
-		// define the leg_rank_average as the average over the interval and add this
-		// to a list/array indexed by legs sequentially (append)
-
-		if steps > LEG_WINDOW {
-
-			steps = 0
-			leg_rank_average := rank_sum / float64(LEG_WINDOW)
-			av_rank_for_leg = append(av_rank_for_leg,leg_rank_average)
-			rank_sum = 0
-		}
-
-		steps++	
-	}
-
-	// Don't forget any final "short" leg if there is one (residuals from the loop < LEG_WINDOW)
-
-	leg_rank_average := rank_sum / float64(steps)
-	av_rank_for_leg = append(av_rank_for_leg,leg_rank_average)
-
-	// Find the leg of maximum importance
-
-	var max_all_legs float64 = 0
-
-	for l := range av_rank_for_leg {
-
-		if max_all_legs < av_rank_for_leg[l] {
-
-			max_all_legs = av_rank_for_leg[l]
-		}
-	}
-
-	// Select a sampling rate that's lazy (> 1 sentence per leg) or busy ( <a few)
-	// for important legs
-
-	steps = 0
-	leg = 0
-	var this_leg_av_rank float64 = av_rank_for_leg[0]
-
-	var sentence_id_by_rank = make(map[int]map[float64]int)
-	sentence_id_by_rank[0] = make(map[float64]int)
-
-	// Go through all the sentences that haven't been excluded and pick a sampling density that's
-	// approximately evenly distributed-- split into LEG_WINDOW intervals
-
-	for s := range selected_sentences {
-
-		sentence_id_by_rank[leg][selected_sentences[s].rank] = s
-
-		if steps > LEG_WINDOW {
-
-			this_leg_av_rank = av_rank_for_leg[leg]
-
-			// At the start of a long doc, there's insufficient weight to make an impact, so
-			// we need to compensate by some arbitrary amount, this needs to be replaced by a ratio?
-			// Based on word density...
-
-			AnnotateLeg(filename, selected_sentences, leg, sentence_id_by_rank[leg], this_leg_av_rank, max_all_legs)
-
-			steps = 0
-			leg++
-
-			sentence_id_by_rank[leg] = make(map[float64]int)
-		}
-
-		steps++
-	}
-
-	// Don't forget the final remainder (catch leg++)
-
-	this_leg_av_rank = av_rank_for_leg[leg]
-	
-	AnnotateLeg(filename, selected_sentences, leg, sentence_id_by_rank[leg], this_leg_av_rank, max_all_legs)
-
-	// Summarize	
-
-	Println("------------------------------------------")
-	Println("Notable events = ",KEPT,"of total ",ALL_SENTENCE_INDEX,"efficiency = ",100*float64(ALL_SENTENCE_INDEX)/float64(KEPT),"%")
-	Println("------------------------------------------\n")
+	f := DefaultFractionator()
+	FractionatorReviewAndSelectEvents(f,filename,selected_sentences)
+	SaveDefaultFractionator(f)
 }
 
 //**************************************************************
@@ -3397,184 +3294,30 @@ func StaticIntent(g Analytics,str string) float64 {
 
 func Intentionality(n int, s string, sentence_count int) float64 {
 
-	// Compute the effective intent of a string s at a position count
-	// within a document of many sentences. The weighting due to
-	// inband learning uses an exponential deprecation based on
-	// SST scales (see "leg" meaning).
-
-	occurrences := STM_NGRAM_RANK[n][s]
-	work := float64(len(s))
-	legs := float64(sentence_count) / float64(LEG_WINDOW)
-
-	if occurrences < 3 {
-		return 0
-	}
-
-	if work < 5 {
-		return 0
-	}
-
-	// lambda should have a cutoff for insignificant words, like "a" , "of", etc that occur most often
-
-	lambda := occurrences / float64(LEG_WINDOW)
+	// Compute the effective intent of a string s, as learned by the
+	// default fractionator (see FractionatorIntentionality)
 
-	// This constant is tuned to give words a growing importance up to a limit
-	// or peak occurrences, then downgrade
-
-	// Things that are repeated too often are not important
-	// but length indicates purposeful intent
-
-	meaning := lambda * work / (1.0 + math.Exp(lambda-legs))
-
-return meaning
+	return FractionatorIntentionality(DefaultFractionator(),n,s,sentence_count)
 }
 
 //**************************************************************
 
 func AnnotateLeg(filename string, selected_sentences []Narrative, leg int, sentence_id_by_rank map[float64]int, this_leg_av_rank, max float64) {
 
-	// For each quasi paragraph or "leg" of a document text, we expect a persistence
-	// of intent over the region (in other words, an inertia for talking about the same
-	// thing) analyse the Narrative subselections to skim off only the most important
-	// intentional sentences at a fixed rate per leg. This captures spacetime process at
-	// a fixed rate of reporting so that we don't hop over large parts of the text that
-	// are stylistcally different.
-
-	var sentence_ranks []float64
-	var ranks_in_order []int
-
-	key := make(map[float64]int)
-
-	for fl := range sentence_id_by_rank {
-
-		sentence_ranks = append(sentence_ranks,fl)
-	}
-
-	var samples_per_leg = len(sentence_ranks)
-
-	if samples_per_leg < 1 {
-		return
-	}
-
-	// Rank by importance and rescale all as dimensionless between [0,1]
-
-	sort.Float64s(sentence_ranks)
-	scale_free_trust := this_leg_av_rank / max
-
-	// We now have an array of sentences whose indices are ascending ordered rankings, max = last
-	// and an array of rankings min to max
-	// Set up a key = sentence with rank = r as key[r]
-
-	for i := range sentence_ranks {
-		key[sentence_ranks[i]] = sentence_id_by_rank[sentence_ranks[i]]
-	}
-
-	// Select only the most important remaining in order for the hub
-	// Hubs will overlap with each other, so some will be "near" others i.e. "approx" them
-	// We want the degree of overlap between hubs TT.CompareContexts()
-
-	Println("\n >> (Rank leg interest potential (anomalous intent)",leg,"=",scale_free_trust,")")
-
-	// How do we quantitatively adjust output rate/velocity based on above threshold deviation
-
-	var detail_per_leg_policy int
-
-	if scale_free_trust > 0 { // Always true (legacy)
-
-		var start int
-
-		// Scale processing velocity like sqrt of probable mistrust event rate per leg
-
-		detail_per_leg_policy = int(0.5 + math.Sqrt(float64(LEG_WINDOW) * scale_free_trust))
-
-		Println(" >> (Dynamic kinetic event selection velocity", detail_per_leg_policy,"(events per leg)",LEG_WINDOW,")")
-
-		// top intra_leg_sampling_density = count backwards from the end
-
-		if samples_per_leg > detail_per_leg_policy {
-
-			start = len(sentence_ranks) - detail_per_leg_policy
-
-		} else {
-			start = 0
-		}
-
-		for i :=  start; i < len(sentence_ranks); i++ {
-
-			r := key[sentence_ranks[i]]
-			ranks_in_order = append(ranks_in_order,r)
-		}
-
-		// Put the ranked selections back in sentence order
-
-		sort.Ints(ranks_in_order)
-
-	}
-
-	// Now highest importance within the lef, in order of occurrence
-
-	for r := range ranks_in_order {
-
-		Printf("\nEVENT[Leg %d selects %d]: %s\n",leg,ranks_in_order[r],selected_sentences[ranks_in_order[r]].text)
-		LEG_SELECTIONS = append(LEG_SELECTIONS,selected_sentences[ranks_in_order[r]].text)
-		KEPT++
-	}
+	f := DefaultFractionator()
+	FractionatorAnnotateLeg(f,filename,selected_sentences,leg,sentence_id_by_rank,this_leg_av_rank,max)
+	SaveDefaultFractionator(f)
 }
 
 //**************************************************************
 
 func NextWordAndUpdateLTMNgrams(s_idx int, word string, rrbuffer [MAXCLUSTERS][]string,total_sentences int,ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int) (float64,[MAXCLUSTERS][]string) {
 
-	// Word by word, we form a superposition of scores from n-grams of different lengths
-	// as a simple sum. This means lower lengths will dominate as there are more of them
-	// so we define intentionality proportional to the length also as compensation
+	f := DefaultFractionator()
+	rank,rrbuffer := FractionatorNextWord(f,s_idx,word,rrbuffer,total_sentences,ltm_every_ngram_occurrence)
+	SaveDefaultFractionator(f)
 
-	var rank float64 = 0
-
-	for n := 2; n < MAXCLUSTERS; n++ {
-		
-		// Pop from round-robin
-
-		if (len(rrbuffer[n]) > n-1) {
-			rrbuffer[n] = rrbuffer[n][1:n]
-		}
-		
-		// Push new to maintain length
-
-		rrbuffer[n] = append(rrbuffer[n],word)
-
-		// Assemble the key, only if complete cluster
-		
-		if (len(rrbuffer[n]) > n-1) {
-			
-			var key string
-			
-			for j := 0; j < n; j++ {
-				key = key + rrbuffer[n][j]
-				if j < n-1 {
-					key = key + " "
-				}
-			}
-
-			if ExcludedByBindings(rrbuffer[n][0],rrbuffer[n][n-1]) {
-
-				continue
-			}
-
-			STM_NGRAM_RANK[n][key]++
-			rank += Intentionality(n,key,total_sentences)
-
-			ltm_every_ngram_occurrence[n][key] = append(ltm_every_ngram_occurrence[n][key],s_idx)
-
-		}
-	}
-
-	STM_NGRAM_RANK[1][word]++
-	rank += Intentionality(1,word,total_sentences)
-
-	ltm_every_ngram_occurrence[1][word] = append(ltm_every_ngram_occurrence[1][word],s_idx)
-
-	return rank, rrbuffer
+	return rank,rrbuffer
 }
 
 //**************************************************************
@@ -3671,297 +3414,77 @@ func Print(a ...any) (n int, err error) {
 //  EndService(lock)
 // *****************************************************************
 
-const LOCKDIR = "/tmp" // this should REALLY be a private, secure location
+var LOCKDIR = DefaultLockDir() // private to this user, see locks.go
 const NEVER = 0
 
 type Lock struct {
 
 	Ready bool
+	Name  string
 	This  string
 	Last  string
+	Owner LockOwner
 }
 
 // *****************************************************************
 
-func BeginService(name string, ifelapsed,expireafter int64, now int64) Lock {
+func BeginService(name string, ifelapsed,expireafter int64, now int64) (Lock,error) {
 
-	var lock Lock
-
-	lock.Last = fmt.Sprintf("%s/last.%s",LOCKDIR,name)
-	lock.This = fmt.Sprintf("%s/lock.%s",LOCKDIR,name)
-	lock.Ready = true
-	
-	lastcompleted := GetLockTime(lock.Last)
-
-	elapsedtime := (now - lastcompleted) / NANO // in seconds
-
-	Println("Check elapsed time...",elapsedtime,ifelapsed)
-	
-	if (elapsedtime < ifelapsed) {
-
-		Println("Too soon since last",lock.Last,elapsedtime,"/",ifelapsed)
-		lock.Ready = false
-		return lock
-	}
-
-	starttime := GetLockTime(lock.This)
-
-	Println("Looking for current lock...")
-
-	if (starttime == NEVER) {
-
-		Println("No running lock...")
-
-	} else {
-
-		runtime := (now-starttime) / NANO
-
-		if (runtime > expireafter) {
-
-			// server threads can't be forced to quit, 
-			// so we can only ask nicely to release resources
-			// as part of a standard promise
-			// If the thread can change something downstream, it needs to be stopped
-			// For a read only server process, it's safe to continue
-
-			RemoveLock(lock.This)
-		}
-	}
-
-	AcquireLock(lock.This)
-	return lock
-}
-
-// *****************************************************************
-
-func EndService(lock Lock) {
-
-	RemoveLock(lock.This)
-	RemoveLock(lock.Last)
-	AcquireLock(lock.Last)
-}
-
-// *****************************************************************
-
-func GetLockTime(filename string) int64 {
-
-	fileinfo, err := os.Stat(filename)
+	locker, err := GetLocker()
 
 	if err != nil {
-		if os.IsNotExist(err) {
-
-			return NEVER
-
-		} else {
-			fmt.Println("Insufficient permission",err)
-			os.Exit(1)
-		}
+		return Lock{ Name: name }, err
 	}
 
-	return fileinfo.ModTime().UnixNano()
+	return locker.Acquire(name,ifelapsed,expireafter,now)
 }
 
 // *****************************************************************
 
-func AcquireLock(name string) {
+func EndService(lock Lock) error {
 
-	f, err := os.OpenFile(name,os.O_CREATE|os.O_WRONLY, 0644)
-
-	if err != nil {
-		fmt.Println("Couldn't acquire lock to create",name,err)
-		return
+	if lock.This == "" {
+		return nil  // admission control only, no lock was taken
 	}
 
-	f.Close()
-}
-
-// *****************************************************************
-
-func RemoveLock(name string) {
-
-	err := os.Remove(name)
+	locker, err := GetLocker()
 
 	if err != nil {
-		Println("Unable to remove",name,err)
-	}
-}
-
-// ***********************************************************************
-
-func ContextEval(s string) (string,float64) {
-
-	// Return an estimated confidence in the quasi-Boolean expression s
-
-	expr := CleanExpression(s)
-
-	or_parts := SplitWithParensIntact(expr,'|')
-
-	or_result := 0.0
-
-	for or_frag := range or_parts {
-
-		and_parts := SplitWithParensIntact(or_parts[or_frag],'.') 
-
-		and_result := 1.0
-
-		for and_frag := range and_parts {
-
-			if s[0] == '(' && and_parts[and_frag] == s {
-				fmt.Println("\nIrreducible context expression: ",s,"\n")
-				return "bad expression", -1.0
-			}
-
-			var res float64
-			token := strings.TrimSpace(and_parts[and_frag])
-			
-			switch token[0] {
-
-			case '!':
-				switch token[1] {
-				case '(': 
-					_,res = ContextEval(token[1:])
-				default:
-					res = CONTEXT[token[1:]]
-				}
-
-				if res > 0 {
-					res = 0
-				} else {
-					res = 1
-				}
-
-			case '(': 
-				_,res = ContextEval(token)
-			default:
-				res = CONTEXT[token]
-			}
-
-			and_result *= res
-		}
-
-		or_result += and_result
+		return err
 	}
 
-	return expr,or_result
+	return locker.Release(lock,CLOCK.Now().UnixNano())
 }
 
 // ***********************************************************************
 
-func CleanExpression(s string) string {
-
-	s = TrimParen(s)
-
-	r1 := regexp.MustCompile("[|]+") 
-	s = r1.ReplaceAllString(s,"|") 
-	r2 := regexp.MustCompile("[&]+") 
-	s = r2.ReplaceAllString(s,".") 
-	r3 := regexp.MustCompile("[.]+") 
-	s = r3.ReplaceAllString(s,".") 
-	return s
-}
-
-// ***********************************************************************
-
-func SplitWithParensIntact(expr string,split_ch byte) []string {
-
-	var token string = ""
-	var set []string
-
-	for c := 0; c < len(expr); c++ {
-
-		switch expr[c] {
-
-		case split_ch:
-			set = append(set,token)
-			token = ""
-
-		case '(':
-			subtoken,offset := Paren(expr,c)
-			token += subtoken
-			c = offset-1
-
-		default:
-			token += string(expr[c])
-		}
-	}
-
-	if len(token) > 0 {
-		set = append(set,token)
-	}
-
-	return set
-} 
-
-// ***********************************************************************
-
-func Paren(s string, offset int) (string,int) {
+func ContextEval(s string) (string,float64) {
 
-	var level int = 0
+	// Return an estimated confidence in the quasi-Boolean expression s,
+	// with its canonical form. See context_expr.go for the grammar
 
-	for c := offset; c < len(s); c++ {
+	expr, err := CompileContextCached(s)
 
-		if s[c] == '(' {
-			level++
-			continue
-		}
-
-		if s[c] == ')' {
-			level--
-			if level == 0 {
-				token := s[offset:c+1]
-				return token, c+1
-			}
-		}
+	if err != nil {
+		fmt.Println("\nBad context expression:",err)
+		return "bad expression", -1.0
 	}
 
-	return "bad expression", -1
+	return ContextString(expr.Root), ContextStoreEval(CONTEXT,expr,CLOCK.Now().UnixNano())
 }
 
-
 // ***********************************************************************
 
-func TrimParen(s string) string {
+func ContextEvalWith(s string, semantics string) (string,float64) {
 
-	var level int = 0
-	var trim = true
+	// As ContextEval, with a choice of fuzzy semantics (FUZZY_*)
 
-	if len(s) == 0 {
-		return s
-	}
+	expr, err := CompileContextCached(s)
 
-	s = strings.TrimSpace(s)
-
-	if s[0] != '(' {
-		return s
+	if err != nil {
+		fmt.Println("\nBad context expression:",err)
+		return "bad expression", -1.0
 	}
 
-	for c := 0; c < len(s); c++ {
-
-		if s[c] == '(' {
-			level++
-			continue
-		}
-
-		if level == 0 && c < len(s)-1 {
-			trim = false
-		}
-		
-		if s[c] == ')' {
-			level--
-
-			if level == 0 && c == len(s)-1 {
-				
-				var token string
-				
-				if trim {
-					token = s[1:len(s)-1]
-				} else {
-					token = s
-				}
-				return token
-			}
-		}
-	}
-	
-	return s
+	return ContextString(expr.Root), EvalContextWith(expr,ContextStoreValues(CONTEXT,CLOCK.Now().UnixNano()),semantics)
 }
@@ -0,0 +1,255 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Admission control - token buckets, sliding windows, trust weighted quotas
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ****************************************************************************
+// The ifelapsed rule admits one request per interval, whoever is asking and
+// however they ask. An admission policy instead gives each promise key a
+// quota, either as a token bucket (a sustained rate plus a burst) or as a
+// sliding window count, and scales the quota by how far we trust the key:
+//
+//   quota = base * (1 + trust_weight * (2 * reliability - 1))
+//
+// so with trust_weight 1, a fully reliable client gets twice the base and an
+// unreliable one almost nothing. Promise policy, e.g.
+//
+//   "admission": { "kind": "token_bucket", "rate": 0.5, "burst": 5, "trust_weight": 1 }
+//   "admission": { "kind": "sliding_window", "window": 60, "limit": 20 }
+//
+// State is kept in memory, per process.
+// ****************************************************************************
+
+const ADMISSION_TOKEN_BUCKET = "token_bucket"
+const ADMISSION_SLIDING_WINDOW = "sliding_window"
+
+const ADMISSION_MIN_SHARE = 0.1 // the least trusted still get this fraction of the base quota
+
+// ****************************************************************************
+
+type AdmissionPolicy struct {
+
+	Kind        string  `json:"kind"`          // ADMISSION_TOKEN_BUCKET or ADMISSION_SLIDING_WINDOW
+	Rate        float64 `json:"rate"`          // token bucket refill, requests per second
+	Burst       float64 `json:"burst"`         // token bucket capacity
+	Window      int64   `json:"window"`        // sliding window length (s)
+	Limit       float64 `json:"limit"`         // requests per sliding window
+	TrustWeight float64 `json:"trust_weight"`  // 0 = the same quota for everyone
+}
+
+// ****************************************************************************
+
+type TokenBucket struct {
+
+	Tokens float64
+	Last   int64   // ns
+}
+
+// ****************************************************************************
+
+type SlidingWindow struct {
+
+	Start    int64    // ns, start of the current fixed window
+	Current  float64  // requests in the current window
+	Previous float64  // requests in the one before
+}
+
+// ****************************************************************************
+
+type AdmissionControl struct {
+
+	mutex   sync.Mutex
+	buckets map[string]TokenBucket
+	windows map[string]SlidingWindow
+}
+
+var ADMISSION = NewAdmissionControl()
+
+// ****************************************************************************
+
+func NewAdmissionControl() *AdmissionControl {
+
+	return &AdmissionControl{ buckets: make(map[string]TokenBucket), windows: make(map[string]SlidingWindow) }
+}
+
+// ****************************************************************************
+
+func ValidAdmissionPolicy(p AdmissionPolicy) error {
+
+	switch p.Kind {
+
+	case ADMISSION_TOKEN_BUCKET:
+		if p.Rate <= 0 || p.Burst < 1 {
+			return fmt.Errorf("token bucket needs rate > 0 and burst >= 1")
+		}
+
+	case ADMISSION_SLIDING_WINDOW:
+		if p.Window <= 0 || p.Limit < 1 {
+			return fmt.Errorf("sliding window needs window > 0 and limit >= 1")
+		}
+
+	default:
+		return fmt.Errorf("unknown admission kind \"%s\"",p.Kind)
+	}
+
+	if p.TrustWeight < 0 || p.TrustWeight > 1 {
+		return fmt.Errorf("admission trust_weight should be in [0,1]")
+	}
+
+	return nil
+}
+
+// ****************************************************************************
+
+func TrustQuota(base, reliability, weight float64) float64 {
+
+	factor := 1 + weight * (2 * reliability - 1)
+
+	return base * math.Max(factor,ADMISSION_MIN_SHARE)
+}
+
+// ****************************************************************************
+
+func TokenBucketAdmit(b TokenBucket, rate, burst float64, now int64) (TokenBucket,bool) {
+
+	if b.Last == 0 {
+		b.Tokens = burst  // a new key starts full
+	} else if now > b.Last {
+		b.Tokens += rate * float64(now - b.Last) / NANO
+	}
+
+	b.Tokens = math.Min(b.Tokens,burst)
+	b.Last = now
+
+	if b.Tokens < 1 {
+		return b, false
+	}
+
+	b.Tokens--
+	return b, true
+}
+
+// ****************************************************************************
+
+func SlidingWindowAdmit(w SlidingWindow, window int64, limit float64, now int64) (SlidingWindow,bool) {
+
+	// Two fixed windows, with the previous one weighted by how much of it
+	// still overlaps the sliding window ending now
+
+	length := window * NANO
+	start := now - now % length
+
+	if start != w.Start {
+
+		if start - w.Start == length {
+			w.Previous = w.Current
+		} else {
+			w.Previous = 0
+		}
+
+		w.Current = 0
+		w.Start = start
+	}
+
+	overlap := 1 - float64(now - start) / float64(length)
+	estimate := w.Previous * overlap + w.Current
+
+	if estimate + 1 > limit {
+		return w, false
+	}
+
+	w.Current++
+	return w, true
+}
+
+// ****************************************************************************
+
+func Admit(ac *AdmissionControl, key string, p AdmissionPolicy, reliability float64, now int64) bool {
+
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	var admitted bool
+
+	switch p.Kind {
+
+	case ADMISSION_TOKEN_BUCKET:
+
+		rate := TrustQuota(p.Rate,reliability,p.TrustWeight)
+		burst := math.Max(1,TrustQuota(p.Burst,reliability,p.TrustWeight))
+
+		ac.buckets[key],admitted = TokenBucketAdmit(ac.buckets[key],rate,burst,now)
+
+	case ADMISSION_SLIDING_WINDOW:
+
+		limit := math.Max(1,TrustQuota(p.Limit,reliability,p.TrustWeight))
+
+		ac.windows[key],admitted = SlidingWindowAdmit(ac.windows[key],p.Window,limit,now)
+
+	default:
+		return true
+	}
+
+	Println("Admission",p.Kind,key,"reliability",reliability,"admitted",admitted)
+
+	return admitted
+}
+
+// ****************************************************************************
+
+func AdmissionReliability(g Analytics, ctx_name string, p AdmissionPolicy, now int64) float64 {
+
+	// How far do we trust this promise, for its quota? Only look it up if it matters.
+	// ctx_name is the PromiseContext name, under which StampedPromiseContext_End
+	// keeps the promise's history in BeginEndLocks
+
+	decay := PolicyDecay(GetPromisePolicy(ctx_name))
+
+	if p.TrustWeight == 0 {
+		return decay.Prior
+	}
+
+	_, timeslot := DoughNowt(time.Unix(0,now))
+
+	status := GetTrustStatus(g,"BeginEndLocks",ctx_name+":"+timeslot,now)
+
+	return status.Reliability
+}
+
+// ****************************************************************************
+
+func AdmitService(g Analytics, ctx PromiseContext, name string, p AdmissionPolicy, now int64) Lock {
+
+	// Admission takes no exclusive lock (This is empty), so admitted requests
+	// for the same key may run concurrently, within their quota
+
+	reliability := AdmissionReliability(g,ctx.Name,p,now)
+
+	return Lock{ Name: name, Ready: Admit(ADMISSION,name,p,reliability,now) }
+}
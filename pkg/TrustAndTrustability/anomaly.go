@@ -0,0 +1,280 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Change-point and anomaly detection on PromiseHistory streams
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"math"
+)
+
+// ****************************************************************************
+// The running averages in PromiseHistory are fast (50/50), so they follow a
+// change almost immediately and can't tell us that one happened. Detectors
+// keep a slow reference level for each history and accumulate evidence of
+// departure from it, in units of its standard deviation:
+//
+//  z-score      - a single sample far from the reference (a spike)
+//  CUSUM        - a persistent shift, detected by cumulative sums
+//  Page-Hinkley - a persistent drift, detected from the running minimum
+//
+// The state is persisted with the history, so detection spans processes
+// ****************************************************************************
+
+const ANOMALY_ZSCORE = "zscore"
+const ANOMALY_CUSUM = "cusum"
+const ANOMALY_PAGE_HINKLEY = "page_hinkley"
+
+const ANOMALY_INCREASE = "increase"
+const ANOMALY_DECREASE = "decrease"
+
+// ****************************************************************************
+
+type DetectorPolicy struct {
+
+	Warmup     int64    // samples before any alarms, while the reference settles
+	Rate       float64  // learning rate of the slow reference mean and variance
+	ZThreshold float64  // sigmas for a single sample spike
+	CusumK     float64  // CUSUM slack, sigmas
+	CusumH     float64  // CUSUM decision threshold, sigmas
+	PHDelta    float64  // Page-Hinkley tolerance, sigmas
+	PHLambda   float64  // Page-Hinkley decision threshold, sigmas
+	Contexts   bool     // raise CONTEXT classes for anomalies
+}
+
+var ANOMALY_DETECTION = DetectorPolicy{
+
+	Warmup:     10,
+	Rate:       0.05,
+	ZThreshold: 3,
+	CusumK:     0.5,
+	CusumH:     5,
+	PHDelta:    0.5,
+	PHLambda:   10,
+	Contexts:   true,
+}
+
+// ****************************************************************************
+
+type DetectorState struct {
+
+	N          int64    `json:"n"`
+	Mean       float64  `json:"mean"`
+	Var        float64  `json:"var"`
+
+	CusumPos   float64  `json:"cusum_pos"`
+	CusumNeg   float64  `json:"cusum_neg"`
+	CusumPosT  int64    `json:"cusum_pos_t"`  // onset of the current positive run
+	CusumNegT  int64    `json:"cusum_neg_t"`
+
+	PHUp       float64  `json:"ph_up"`
+	PHUpMin    float64  `json:"ph_up_min"`
+	PHUpT      int64    `json:"ph_up_t"`      // time of the running minimum
+	PHDown     float64  `json:"ph_down"`
+	PHDownMin  float64  `json:"ph_down_min"`
+	PHDownT    int64    `json:"ph_down_t"`
+}
+
+// ****************************************************************************
+
+type AnomalyEvent struct {
+
+	PromiseId string
+	Detector  string   // ANOMALY_ZSCORE, ANOMALY_CUSUM or ANOMALY_PAGE_HINKLEY
+	Direction string   // ANOMALY_INCREASE or ANOMALY_DECREASE
+	Onset     int64    // estimated start of the change (same clock as now)
+	Detected  int64
+	Magnitude float64  // departure from the reference, in sigmas
+	Shift     float64  // departure from the reference, in the units of the history
+	Value     float64
+}
+
+// ****************************************************************************
+
+func DetectAnomalies(state DetectorState, key string, now int64, q float64, policy DetectorPolicy) (DetectorState,[]AnomalyEvent) {
+
+	// Advance all detectors by one sample q at time now
+
+	var events []AnomalyEvent
+
+	state.N++
+
+	if state.N == 1 {
+		state.Mean = q
+		state.Var = 0
+		return state, events
+	}
+
+	sigma := math.Sqrt(state.Var)
+	shift := q - state.Mean
+
+	// A perfectly steady signal has no variance, so allow a small relative floor
+
+	sigma = math.Max(sigma,0.01 * math.Abs(state.Mean))
+
+	if state.N <= policy.Warmup || sigma == 0 {
+
+		// Welford style cumulative average while settling
+
+		state.Mean += shift / float64(state.N)
+		state.Var += (shift * (q - state.Mean) - state.Var) / float64(state.N)
+		return state, events
+	}
+
+	z := shift / sigma
+
+	event := AnomalyEvent{ PromiseId: key, Detected: now, Magnitude: z, Shift: shift, Value: q }
+
+	// Single sample spike
+
+	if math.Abs(z) > policy.ZThreshold {
+
+		spike := event
+		spike.Detector = ANOMALY_ZSCORE
+		spike.Onset = now
+		spike.Direction = Direction(z)
+		events = append(events,spike)
+	}
+
+	// Two sided CUSUM
+
+	if state.CusumPos == 0 {
+		state.CusumPosT = now
+	}
+
+	if state.CusumNeg == 0 {
+		state.CusumNegT = now
+	}
+
+	state.CusumPos = math.Max(0,state.CusumPos + z - policy.CusumK)
+	state.CusumNeg = math.Max(0,state.CusumNeg - z - policy.CusumK)
+
+	changed := false
+
+	if state.CusumPos > policy.CusumH || state.CusumNeg > policy.CusumH {
+
+		shifted := event
+		shifted.Detector = ANOMALY_CUSUM
+
+		if state.CusumPos > policy.CusumH {
+			shifted.Onset = state.CusumPosT
+			shifted.Direction = ANOMALY_INCREASE
+		} else {
+			shifted.Onset = state.CusumNegT
+			shifted.Direction = ANOMALY_DECREASE
+		}
+
+		events = append(events,shifted)
+		changed = true
+	}
+
+	// Page-Hinkley, in both directions
+
+	if state.PHUpT == 0 {
+		state.PHUpT = now
+		state.PHDownT = now
+	}
+
+	state.PHUp += z - policy.PHDelta
+	state.PHDown += -z - policy.PHDelta
+
+	if state.PHUp < state.PHUpMin {
+		state.PHUpMin = state.PHUp
+		state.PHUpT = now
+	}
+
+	if state.PHDown < state.PHDownMin {
+		state.PHDownMin = state.PHDown
+		state.PHDownT = now
+	}
+
+	if state.PHUp - state.PHUpMin > policy.PHLambda || state.PHDown - state.PHDownMin > policy.PHLambda {
+
+		drift := event
+		drift.Detector = ANOMALY_PAGE_HINKLEY
+
+		if state.PHUp - state.PHUpMin > policy.PHLambda {
+			drift.Onset = state.PHUpT
+			drift.Direction = ANOMALY_INCREASE
+		} else {
+			drift.Onset = state.PHDownT
+			drift.Direction = ANOMALY_DECREASE
+		}
+
+		events = append(events,drift)
+		changed = true
+	}
+
+	if changed {
+
+		// A new regime: re-baseline on the present level and start over
+
+		state = DetectorState{ N: 1, Mean: q, Var: state.Var }
+		return state, events
+	}
+
+	// Slow reference, not disturbed by isolated spikes
+
+	if math.Abs(z) <= policy.ZThreshold {
+		state.Mean += policy.Rate * shift
+		state.Var = (1 - policy.Rate) * state.Var + policy.Rate * shift * shift
+	}
+
+	return state, events
+}
+
+// ****************************************************************************
+
+func Direction(x float64) string {
+
+	if x < 0 {
+		return ANOMALY_DECREASE
+	}
+
+	return ANOMALY_INCREASE
+}
+
+// ****************************************************************************
+
+func RaiseAnomalyContexts(quantity string, events []AnomalyEvent) {
+
+	// e.g. latency_regime_change, latency_spike, latency_increase
+
+	if !ANOMALY_DETECTION.Contexts {
+		return
+	}
+
+	prefix := ClassName(quantity)
+
+	for _,ev := range events {
+
+		switch ev.Detector {
+
+		case ANOMALY_ZSCORE:
+			ContextAdd(prefix + "_spike")
+
+		case ANOMALY_CUSUM, ANOMALY_PAGE_HINKLEY:
+			ContextAdd(prefix + "_regime_change")
+		}
+
+		ContextAdd(prefix + "_" + ev.Direction)
+	}
+}
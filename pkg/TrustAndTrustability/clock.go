@@ -0,0 +1,78 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Injectable clock, so that promise histories can be replayed exactly
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"time"
+)
+
+// ****************************************************************************
+
+type Clock interface {
+
+	Now() time.Time
+}
+
+// ****************************************************************************
+
+type SystemClock struct {
+}
+
+func (c SystemClock) Now() time.Time {
+
+	return time.Now()
+}
+
+// ****************************************************************************
+
+type ReplayClock struct {
+
+	T time.Time
+}
+
+func (c *ReplayClock) Now() time.Time {
+
+	return c.T
+}
+
+func (c *ReplayClock) Set(t time.Time) {
+
+	c.T = t
+}
+
+// ****************************************************************************
+
+// The source of "now" for the promise machinery and its locks
+
+var CLOCK Clock = SystemClock{}
+
+// ****************************************************************************
+
+func SetClock(c Clock) Clock {
+
+	// Returns the previous clock, so that it can be restored
+
+	previous := CLOCK
+	CLOCK = c
+	return previous
+}
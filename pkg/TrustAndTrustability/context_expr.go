@@ -0,0 +1,629 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Context expressions, CFEngine style - lexer, parser and evaluator
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ****************************************************************************
+// Grammar, with '.' and '&' binding tighter than '|', as in CFEngine:
+//
+//   expr    := and ( '|' and )*
+//   and     := unary ( ( '&' | '.' ) unary )*
+//   unary   := '!' unary | primary
+//   primary := class | "quoted class" | '(' expr ')'
+//
+// Class names are letters, digits and '_'; anything else can be quoted with
+// "..." or '...' (backslash escapes the next character). Doubled operators
+// (&&, ||, ..) mean the same as single ones. Expressions are compiled once
+// into a tree and can then be evaluated against any context.
+// ****************************************************************************
+
+const CTX_CLASS = "class"
+const CTX_AND = "and"
+const CTX_OR = "or"
+const CTX_NOT = "not"
+
+// ****************************************************************************
+
+type ContextNode struct {
+
+	Op    string          // CTX_CLASS, CTX_AND, CTX_OR or CTX_NOT
+	Class string          // for CTX_CLASS
+	Args  []*ContextNode  // operands
+	Pos   int             // byte offset in the source
+}
+
+// ****************************************************************************
+
+type ContextExpression struct {
+
+	Source string
+	Root   *ContextNode
+}
+
+// ****************************************************************************
+
+type ContextSyntaxError struct {
+
+	Expr string
+	Pos  int     // byte offset, 0 based
+	Msg  string
+}
+
+func (e *ContextSyntaxError) Error() string {
+
+	return fmt.Sprintf("context expression \"%s\" at position %d: %s\n  %s\n  %s^",e.Expr,e.Pos+1,e.Msg,e.Expr,strings.Repeat(" ",utf8.RuneCountInString(e.Expr[:e.Pos])))
+}
+
+// ****************************************************************************
+// Lexer
+// ****************************************************************************
+
+const (
+	tok_class = iota
+	tok_and
+	tok_or
+	tok_not
+	tok_lparen
+	tok_rparen
+	tok_eof
+)
+
+type ContextToken struct {
+
+	Kind int
+	Text string
+	Pos  int
+}
+
+// ****************************************************************************
+
+func LexContext(s string) ([]ContextToken,error) {
+
+	var tokens []ContextToken
+
+	for pos := 0; pos < len(s); {
+
+		r, width := utf8.DecodeRuneInString(s[pos:])
+
+		switch {
+
+		case unicode.IsSpace(r):
+			pos += width
+
+		case r == '&' || r == '.' || r == '|':
+
+			// A run of the same operator is one operator
+
+			kind := tok_and
+
+			if r == '|' {
+				kind = tok_or
+			}
+
+			start := pos
+
+			for pos < len(s) && s[pos] == s[start] {
+				pos++
+			}
+
+			tokens = append(tokens,ContextToken{ kind, s[start:pos], start })
+
+		case r == '!':
+			tokens = append(tokens,ContextToken{ tok_not, "!", pos })
+			pos++
+
+		case r == '(':
+			tokens = append(tokens,ContextToken{ tok_lparen, "(", pos })
+			pos++
+
+		case r == ')':
+			tokens = append(tokens,ContextToken{ tok_rparen, ")", pos })
+			pos++
+
+		case r == '"' || r == '\'':
+
+			start := pos
+			quote := s[pos]
+			pos++
+
+			var name strings.Builder
+			closed := false
+
+			for pos < len(s) {
+
+				if s[pos] == '\\' && pos+1 < len(s) {
+					name.WriteByte(s[pos+1])
+					pos += 2
+					continue
+				}
+
+				if s[pos] == quote {
+					closed = true
+					pos++
+					break
+				}
+
+				name.WriteByte(s[pos])
+				pos++
+			}
+
+			if !closed {
+				return nil, &ContextSyntaxError{ s, start, "unterminated quoted class name" }
+			}
+
+			if name.Len() == 0 {
+				return nil, &ContextSyntaxError{ s, start, "empty quoted class name" }
+			}
+
+			tokens = append(tokens,ContextToken{ tok_class, name.String(), start })
+
+		case IsClassRune(r):
+
+			start := pos
+
+			for pos < len(s) {
+
+				r, width = utf8.DecodeRuneInString(s[pos:])
+
+				if !IsClassRune(r) {
+					break
+				}
+
+				pos += width
+			}
+
+			tokens = append(tokens,ContextToken{ tok_class, s[start:pos], start })
+
+		default:
+			return nil, &ContextSyntaxError{ s, pos, fmt.Sprintf("unexpected character '%c' (quote class names with special characters)",r) }
+		}
+	}
+
+	tokens = append(tokens,ContextToken{ tok_eof, "", len(s) })
+
+	return tokens, nil
+}
+
+// ****************************************************************************
+
+func IsClassRune(r rune) bool {
+
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// ****************************************************************************
+// Recursive descent parser
+// ****************************************************************************
+
+type ContextParser struct {
+
+	source string
+	tokens []ContextToken
+	next   int
+}
+
+// ****************************************************************************
+
+func CompileContext(s string) (*ContextExpression,error) {
+
+	tokens, err := LexContext(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ContextParser{ source: s, tokens: tokens }
+
+	if p.peek().Kind == tok_eof {
+		return nil, &ContextSyntaxError{ s, 0, "empty expression" }
+	}
+
+	root, err := ParseContextOr(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.Kind != tok_eof {
+
+		msg := fmt.Sprintf("unexpected '%s' after complete expression",t.Text)
+
+		if t.Kind == tok_rparen {
+			msg = "unmatched ')'"
+		} else if t.Kind == tok_class || t.Kind == tok_lparen || t.Kind == tok_not {
+			msg = fmt.Sprintf("missing operator before '%s'",t.Text)
+		}
+
+		return nil, &ContextSyntaxError{ s, t.Pos, msg }
+	}
+
+	return &ContextExpression{ Source: s, Root: root }, nil
+}
+
+// ****************************************************************************
+
+func (p *ContextParser) peek() ContextToken {
+
+	return p.tokens[p.next]
+}
+
+func (p *ContextParser) take() ContextToken {
+
+	t := p.tokens[p.next]
+
+	if t.Kind != tok_eof {
+		p.next++
+	}
+
+	return t
+}
+
+// ****************************************************************************
+
+func ParseContextOr(p *ContextParser) (*ContextNode,error) {
+
+	first, err := ParseContextAnd(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	node := &ContextNode{ Op: CTX_OR, Args: []*ContextNode{ first }, Pos: first.Pos }
+
+	for p.peek().Kind == tok_or {
+
+		p.take()
+
+		next, err := ParseContextAnd(p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		node.Args = append(node.Args,next)
+	}
+
+	if len(node.Args) == 1 {
+		return first, nil
+	}
+
+	return node, nil
+}
+
+// ****************************************************************************
+
+func ParseContextAnd(p *ContextParser) (*ContextNode,error) {
+
+	first, err := ParseContextUnary(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	node := &ContextNode{ Op: CTX_AND, Args: []*ContextNode{ first }, Pos: first.Pos }
+
+	for p.peek().Kind == tok_and {
+
+		p.take()
+
+		next, err := ParseContextUnary(p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		node.Args = append(node.Args,next)
+	}
+
+	if len(node.Args) == 1 {
+		return first, nil
+	}
+
+	return node, nil
+}
+
+// ****************************************************************************
+
+func ParseContextUnary(p *ContextParser) (*ContextNode,error) {
+
+	t := p.peek()
+
+	if t.Kind == tok_not {
+
+		p.take()
+
+		arg, err := ParseContextUnary(p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &ContextNode{ Op: CTX_NOT, Args: []*ContextNode{ arg }, Pos: t.Pos }, nil
+	}
+
+	return ParseContextPrimary(p)
+}
+
+// ****************************************************************************
+
+func ParseContextPrimary(p *ContextParser) (*ContextNode,error) {
+
+	t := p.take()
+
+	switch t.Kind {
+
+	case tok_class:
+		return &ContextNode{ Op: CTX_CLASS, Class: t.Text, Pos: t.Pos }, nil
+
+	case tok_lparen:
+
+		inner, err := ParseContextOr(p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if close := p.take(); close.Kind != tok_rparen {
+			return nil, &ContextSyntaxError{ p.source, close.Pos, fmt.Sprintf("missing ')' to close '(' at position %d",t.Pos+1) }
+		}
+
+		return inner, nil
+
+	case tok_eof:
+		return nil, &ContextSyntaxError{ p.source, t.Pos, "expression ends where a class or '(' was expected" }
+
+	default:
+		return nil, &ContextSyntaxError{ p.source, t.Pos, fmt.Sprintf("expected a class or '(' but found '%s'",t.Text) }
+	}
+}
+
+// ****************************************************************************
+// Evaluation, with a choice of fuzzy logic
+//
+//   legacy       AND multiplies, OR adds, NOT is 1 only for an absent class
+//   product      a.b = ab, a|b = a + b - ab, !a = 1 - a
+//   zadeh        a.b = min(a,b), a|b = max(a,b), !a = 1 - a
+//   lukasiewicz  a.b = max(0,a+b-1), a|b = min(1,a+b), !a = 1 - a
+//
+// Class values (counts in CONTEXT) are clamped to [0,1] for the fuzzy modes,
+// and results are clamped to [0,1] in every mode.
+// ****************************************************************************
+
+const FUZZY_LEGACY = "legacy"
+const FUZZY_PRODUCT = "product"
+const FUZZY_ZADEH = "zadeh"
+const FUZZY_LUKASIEWICZ = "lukasiewicz"
+
+var CONTEXT_SEMANTICS = FUZZY_LEGACY  // default for EvalContext and ContextEval
+
+// ****************************************************************************
+
+func ValidFuzzySemantics(semantics string) error {
+
+	switch semantics {
+
+	case FUZZY_LEGACY, FUZZY_PRODUCT, FUZZY_ZADEH, FUZZY_LUKASIEWICZ:
+		return nil
+	}
+
+	return fmt.Errorf("unknown fuzzy semantics \"%s\" (legacy, product, zadeh or lukasiewicz)",semantics)
+}
+
+// ****************************************************************************
+
+func EvalContext(expr *ContextExpression, context map[string]float64) float64 {
+
+	return EvalContextWith(expr,context,CONTEXT_SEMANTICS)
+}
+
+// ****************************************************************************
+
+func EvalContextWith(expr *ContextExpression, context map[string]float64, semantics string) float64 {
+
+	return Clamp01(EvalContextNode(expr.Root,context,semantics))
+}
+
+// ****************************************************************************
+
+func EvalContextNode(n *ContextNode, context map[string]float64, semantics string) float64 {
+
+	switch n.Op {
+
+	case CTX_CLASS:
+		if semantics == FUZZY_LEGACY {
+			return context[n.Class]
+		}
+		return Clamp01(context[n.Class])
+
+	case CTX_NOT:
+		a := EvalContextNode(n.Args[0],context,semantics)
+
+		if semantics == FUZZY_LEGACY {
+			if a > 0 {
+				return 0
+			}
+			return 1
+		}
+
+		return 1 - a
+
+	case CTX_AND:
+		result := EvalContextNode(n.Args[0],context,semantics)
+
+		for _,arg := range n.Args[1:] {
+			result = FuzzyAnd(result,EvalContextNode(arg,context,semantics),semantics)
+		}
+
+		return result
+
+	case CTX_OR:
+		result := EvalContextNode(n.Args[0],context,semantics)
+
+		for _,arg := range n.Args[1:] {
+			result = FuzzyOr(result,EvalContextNode(arg,context,semantics),semantics)
+		}
+
+		return result
+	}
+
+	return 0
+}
+
+// ****************************************************************************
+
+func FuzzyAnd(a, b float64, semantics string) float64 {
+
+	switch semantics {
+
+	case FUZZY_ZADEH:
+		return math.Min(a,b)
+
+	case FUZZY_LUKASIEWICZ:
+		return math.Max(0,a+b-1)
+	}
+
+	return a * b  // legacy and product
+}
+
+// ****************************************************************************
+
+func FuzzyOr(a, b float64, semantics string) float64 {
+
+	switch semantics {
+
+	case FUZZY_PRODUCT:
+		return a + b - a * b
+
+	case FUZZY_ZADEH:
+		return math.Max(a,b)
+
+	case FUZZY_LUKASIEWICZ:
+		return math.Min(1,a+b)
+	}
+
+	return a + b  // legacy
+}
+
+// ****************************************************************************
+
+func Clamp01(x float64) float64 {
+
+	return math.Max(0,math.Min(1,x))
+}
+
+// ****************************************************************************
+
+func ContextString(n *ContextNode) string {
+
+	// Canonical form, fully parenthesized where it matters
+
+	switch n.Op {
+
+	case CTX_CLASS:
+		for _,r := range n.Class {
+			if !IsClassRune(r) {
+				return "\"" + strings.NewReplacer("\\","\\\\","\"","\\\"").Replace(n.Class) + "\""
+			}
+		}
+		return n.Class
+
+	case CTX_NOT:
+		arg := ContextString(n.Args[0])
+		if n.Args[0].Op == CTX_AND || n.Args[0].Op == CTX_OR {
+			arg = "(" + arg + ")"
+		}
+		return "!" + arg
+
+	case CTX_AND, CTX_OR:
+
+		var parts []string
+		sep := "."
+
+		if n.Op == CTX_OR {
+			sep = "|"
+		}
+
+		for _,arg := range n.Args {
+
+			s := ContextString(arg)
+
+			if n.Op == CTX_AND && arg.Op == CTX_OR {
+				s = "(" + s + ")"
+			}
+
+			parts = append(parts,s)
+		}
+
+		return strings.Join(parts,sep)
+	}
+
+	return ""
+}
+
+// ****************************************************************************
+
+func ContextClasses(n *ContextNode) []string {
+
+	// The class names an expression depends on
+
+	if n.Op == CTX_CLASS {
+		return []string{ n.Class }
+	}
+
+	var classes []string
+
+	for _,arg := range n.Args {
+		for _,c := range ContextClasses(arg) {
+			classes = AppendIfNew(classes,c)
+		}
+	}
+
+	return classes
+}
+
+// ****************************************************************************
+
+var CONTEXT_CACHE sync.Map  // source -> *ContextExpression, for ContextEval
+
+func CompileContextCached(s string) (*ContextExpression,error) {
+
+	if expr, ok := CONTEXT_CACHE.Load(s); ok {
+		return expr.(*ContextExpression), nil
+	}
+
+	expr, err := CompileContext(s)
+
+	if err == nil {
+		CONTEXT_CACHE.Store(s,expr)
+	}
+
+	return expr, err
+}
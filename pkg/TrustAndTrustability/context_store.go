@@ -0,0 +1,434 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Context store - timestamped classes, with decay, expiry and persistence
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// ****************************************************************************
+// Each class remembers when it was first and last raised. A store may let
+// old evidence fade exponentially (half life), or forget a class entirely
+// when it hasn't been raised for a while (TTL), or both. The store is safe
+// for concurrent use. TT.CONTEXT is the default store, used by ContextAdd,
+// ContextSet and ContextEval.
+// ****************************************************************************
+
+const CONTEXT_SNAPSHOTS = "ContextSnapshots"
+const EPISODE_CONTEXTS = "EpisodeContexts"
+
+// ****************************************************************************
+
+type ContextClass struct {
+
+	Value float64 `json:"value"`  // count, or degree, at time Last
+	First int64   `json:"first"`  // ns
+	Last  int64   `json:"last"`   // ns
+}
+
+// ****************************************************************************
+
+type ContextStore struct {
+
+	mutex     sync.RWMutex
+	classes   map[string]ContextClass
+	timed     []string  // the time classes last defined by DefineTimeClasses
+
+	HalfLife  float64  // seconds, 0 = no decay
+	TTL       float64  // seconds since last raised, 0 = never expire
+	Semantics string   // fuzzy semantics for evaluation, "" = CONTEXT_SEMANTICS
+}
+
+// ****************************************************************************
+
+type ContextSnapshot struct {
+
+	Key       string                  `json:"_key"`
+	Time      int64                   `json:"time"`
+	HalfLife  float64                 `json:"half_life"`
+	TTL       float64                 `json:"ttl"`
+	Semantics string                  `json:"semantics"`
+	Classes   map[string]ContextClass `json:"classes"`
+}
+
+// ****************************************************************************
+
+type EpisodeContext struct {
+
+	Key     string             `json:"_key"`
+	Episode string             `json:"episode"`
+	Time    int64              `json:"time"`
+	Set     []string           `json:"set"`      // ContextSet at the end of the episode
+	Values  map[string]float64 `json:"values"`
+}
+
+// ****************************************************************************
+
+var CONTEXT = NewContextStore()
+
+// ****************************************************************************
+
+func NewContextStore() *ContextStore {
+
+	return &ContextStore{ classes: make(map[string]ContextClass) }
+}
+
+// ****************************************************************************
+
+func ContextClassValue(c ContextClass, cs *ContextStore, now int64) float64 {
+
+	// The value of a class as seen at time now
+
+	age := float64(now - c.Last) / NANO
+
+	if cs.TTL > 0 && age > cs.TTL {
+		return 0
+	}
+
+	if cs.HalfLife > 0 && age > 0 {
+		return c.Value * math.Pow(2,-age/cs.HalfLife)
+	}
+
+	return c.Value
+}
+
+// ****************************************************************************
+
+func ContextStoreAdd(cs *ContextStore, class string, now int64) {
+
+	// Raise a class once more, on top of what remains of it
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	c, exists := cs.classes[class]
+
+	if !exists || ContextClassValue(c,cs,now) == 0 {
+		c = ContextClass{ First: now }
+	} else {
+		c.Value = ContextClassValue(c,cs,now)
+	}
+
+	c.Value++
+	c.Last = now
+	cs.classes[class] = c
+}
+
+// ****************************************************************************
+
+func ContextStoreSetValue(cs *ContextStore, class string, value float64, now int64) {
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	c, exists := cs.classes[class]
+
+	if !exists {
+		c.First = now
+	}
+
+	c.Value = value
+	c.Last = now
+	cs.classes[class] = c
+}
+
+// ****************************************************************************
+
+func ContextStoreValue(cs *ContextStore, class string, now int64) float64 {
+
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	c, exists := cs.classes[class]
+
+	if !exists {
+		return 0
+	}
+
+	return ContextClassValue(c,cs,now)
+}
+
+// ****************************************************************************
+
+func ContextStoreValues(cs *ContextStore, now int64) map[string]float64 {
+
+	// Everything still present at time now, as a plain map for EvalContext
+
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	values := make(map[string]float64)
+
+	for class,c := range cs.classes {
+
+		if v := ContextClassValue(c,cs,now); v > 0 {
+			values[class] = v
+		}
+	}
+
+	return values
+}
+
+// ****************************************************************************
+
+func ContextStoreSet(cs *ContextStore, now int64) []string {
+
+	var result []string
+
+	for class := range ContextStoreValues(cs,now) {
+		result = append(result,class)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// ****************************************************************************
+
+func ContextStoreExpire(cs *ContextStore, now int64) int {
+
+	// Drop classes that have expired, or decayed to nothing; returns how many
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	const negligible = 1e-6
+	count := 0
+
+	for class,c := range cs.classes {
+
+		if ContextClassValue(c,cs,now) < negligible {
+			delete(cs.classes,class)
+			count++
+		}
+	}
+
+	return count
+}
+
+// ****************************************************************************
+
+func ContextStoreRemove(cs *ContextStore, class string) {
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	delete(cs.classes,class)
+}
+
+// ****************************************************************************
+
+func ContextStoreReset(cs *ContextStore) {
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.classes = make(map[string]ContextClass)
+	cs.timed = nil
+}
+
+// ****************************************************************************
+
+func ContextStoreEval(cs *ContextStore, expr *ContextExpression, now int64) float64 {
+
+	semantics := cs.Semantics
+
+	if semantics == "" {
+		semantics = CONTEXT_SEMANTICS
+	}
+
+	return EvalContextWith(expr,ContextStoreValues(cs,now),semantics)
+}
+
+// ****************************************************************************
+
+func ContextStoreSnapshot(cs *ContextStore, now int64) ContextSnapshot {
+
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	snap := ContextSnapshot{ Time: now, HalfLife: cs.HalfLife, TTL: cs.TTL, Semantics: cs.Semantics }
+
+	snap.Classes = make(map[string]ContextClass)
+
+	for class,c := range cs.classes {
+		snap.Classes[class] = c
+	}
+
+	return snap
+}
+
+// ****************************************************************************
+
+func ContextStoreRestore(cs *ContextStore, snap ContextSnapshot) {
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.HalfLife = snap.HalfLife
+	cs.TTL = snap.TTL
+	cs.Semantics = snap.Semantics
+	cs.classes = make(map[string]ContextClass)
+
+	for class,c := range snap.Classes {
+		cs.classes[class] = c
+	}
+}
+
+// ****************************************************************************
+
+func SaveContextSnapshot(g Analytics, key string, cs *ContextStore, now int64) {
+
+	snap := ContextStoreSnapshot(cs,now)
+	snap.Key = DocumentKey(key)
+
+	SaveDocument(g,CONTEXT_SNAPSHOTS,snap.Key,snap)
+}
+
+// ****************************************************************************
+
+func LoadContextSnapshot(g Analytics, key string, cs *ContextStore) bool {
+
+	var snap ContextSnapshot
+
+	if !LoadDocument(g,CONTEXT_SNAPSHOTS,DocumentKey(key),&snap) {
+		return false
+	}
+
+	ContextStoreRestore(cs,snap)
+	return true
+}
+
+// ****************************************************************************
+
+func SaveEpisodeContext(g Analytics, episode string, cs *ContextStore, now int64) {
+
+	// Keep the final context of an episode against its key, for later learning
+
+	var ec EpisodeContext
+
+	ec.Key = DocumentKey(episode)
+	ec.Episode = episode
+	ec.Time = now
+	ec.Values = ContextStoreValues(cs,now)
+	ec.Set = ContextStoreSet(cs,now)
+
+	SaveDocument(g,EPISODE_CONTEXTS,ec.Key,ec)
+}
+
+// ****************************************************************************
+
+func GetEpisodeContext(g Analytics, episode string) (EpisodeContext,bool) {
+
+	var ec EpisodeContext
+
+	found := LoadDocument(g,EPISODE_CONTEXTS,DocumentKey(episode),&ec)
+
+	return ec, found
+}
+
+// ****************************************************************************
+
+var DOCKEY_UNSAFE = regexp.MustCompile("[^a-zA-Z0-9_:.@()+,=;$!*'%-]")
+
+func DocumentKey(s string) string {
+
+	// Arango keys allow only some characters, up to 254 bytes. Anything
+	// altered carries a hash of the original, so keys don't collide
+
+	key := DOCKEY_UNSAFE.ReplaceAllString(s,"_")
+
+	if key != s || len(key) > 200 || key == "" {
+
+		if len(key) > 200 {
+			key = key[:200]
+		}
+
+		key = key + "-" + fnvhash([]byte(s))
+	}
+
+	return key
+}
+
+// ****************************************************************************
+
+func SaveDocument(g Analytics, collname, key string, doc interface{}) {
+
+	coll, err := g.S_db.Collection(nil, collname)
+
+	if err != nil {
+		coll, err = g.S_db.CreateCollection(nil, collname, nil)
+
+		if err != nil {
+			fmt.Println("SaveDocument: no such collection",collname,err)
+			return
+		}
+	}
+
+	exists,_ := coll.DocumentExists(nil,key)
+
+	if exists {
+		_,err = coll.ReplaceDocument(nil,key,doc)
+	} else {
+		_,err = coll.CreateDocument(nil,doc)
+	}
+
+	if err != nil {
+		fmt.Println("SaveDocument: failed to write",collname,key,err)
+	}
+}
+
+// ****************************************************************************
+
+func LoadDocument(g Analytics, collname, key string, doc interface{}) bool {
+
+	exists,_ := g.S_db.CollectionExists(nil,collname)
+
+	if !exists {
+		return false
+	}
+
+	coll, err := g.S_db.Collection(nil, collname)
+
+	if err != nil {
+		return false
+	}
+
+	if found,_ := coll.DocumentExists(nil,key); !found {
+		return false
+	}
+
+	_,err = coll.ReadDocument(nil,key,doc)
+
+	if err != nil {
+		fmt.Println("LoadDocument: failed to read",collname,key,err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,343 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Error budgets and burn rates - how fast are we breaking a promise?
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	A "github.com/arangodb/go-driver"
+)
+
+// ****************************************************************************
+// An SLO objective, e.g. 99% of outcomes kept over 30 days, leaves an error
+// budget of 1% broken outcomes. The burn rate is the observed error rate
+// relative to that budget: burning at 1 uses it up in exactly one period.
+// Short and long windows are paired, as usual, so a brief spike or an old
+// incident doesn't raise an alarm on its own
+// ****************************************************************************
+
+const BUDGET_COLLECTION = "ErrorBudget"
+const BUDGET_KEPT_LEVEL = 0.5   // promise level at which an outcome counts as kept
+
+const BUDGET_FAST_BURN = "error_budget_fast_burn"
+const BUDGET_SLOW_BURN = "error_budget_slow_burn"
+const BUDGET_EXHAUSTED = "error_budget_exhausted"
+const BUDGET_EXHAUSTION_WARNING = "error_budget_exhaustion_imminent"
+
+// ****************************************************************************
+
+type BurnAlert struct {
+
+	Long      int64    // seconds
+	Short     int64    // seconds
+	Threshold float64  // burn rate that both windows must exceed
+	Class     string   // context to raise
+}
+
+var BURN_ALERTS = []BurnAlert{
+
+	{ Long: 3600,     Short: 300,     Threshold: 14.4, Class: BUDGET_FAST_BURN },
+	{ Long: 6*3600,   Short: 1800,    Threshold: 6,    Class: BUDGET_FAST_BURN },
+	{ Long: 24*3600,  Short: 2*3600,  Threshold: 3,    Class: BUDGET_SLOW_BURN },
+	{ Long: 72*3600,  Short: 6*3600,  Threshold: 1,    Class: BUDGET_SLOW_BURN },
+}
+
+// ****************************************************************************
+
+type BudgetWindow struct {
+
+	Key     string  `json:"_key"`
+	Promise string  `json:"promise"`
+	Start   int64   `json:"start"`   // Unix seconds
+	Kept    int64   `json:"kept"`
+	Total   int64   `json:"total"`
+}
+
+// ****************************************************************************
+
+type BurnRate struct {
+
+	Window    int64    // seconds
+	Kept      int64
+	Total     int64
+	ErrorRate float64  // fraction of outcomes not kept
+	Burn      float64  // error rate / error budget
+}
+
+// ****************************************************************************
+
+type ErrorBudget struct {
+
+	Promise          string
+	Objective        float64     // e.g. 0.99
+	Period           int64       // seconds
+
+	Kept             int64       // over the whole period
+	Total            int64
+	Remaining        float64     // fraction of the budget left, may be negative
+	TimeToExhaustion float64     // seconds at the current burn rate, +Inf if not burning
+
+	BurnRates        []BurnRate
+	Alerts           []string    // contexts raised
+}
+
+// ****************************************************************************
+
+func RecordPromiseKept(g Analytics, promise string, now int64, kept bool) {
+
+	// Count one outcome in the budget window containing now (ns)
+
+	coll, err := g.S_db.Collection(nil, BUDGET_COLLECTION)
+
+	if err != nil {
+		coll, err = g.S_db.CreateCollection(nil, BUDGET_COLLECTION, nil)
+
+		if err != nil {
+			fmt.Println("RecordPromiseKept: no such collection",BUDGET_COLLECTION,err)
+			return
+		}
+	}
+
+	var w BudgetWindow
+
+	w.Promise = promise
+	w.Start = WindowStart(now)
+	w.Key = fmt.Sprintf("%s@%d",promise,w.Start)
+
+	exists,_ := coll.DocumentExists(nil,w.Key)
+
+	if exists {
+		_,err = coll.ReadDocument(nil,w.Key,&w)
+
+		if err != nil {
+			fmt.Println("RecordPromiseKept: failed to read",w.Key,err)
+			return
+		}
+	}
+
+	w.Total++
+
+	if kept {
+		w.Kept++
+	}
+
+	if exists {
+		_,err = coll.ReplaceDocument(nil,w.Key,w)
+	} else {
+		_,err = coll.CreateDocument(nil,w)
+	}
+
+	if err != nil {
+		fmt.Println("RecordPromiseKept: failed to write",w.Key,err)
+	}
+}
+
+// ****************************************************************************
+
+func GetBudgetWindow(g Analytics, promise string, from, to int64) (int64,int64) {
+
+	// Sum kept and total outcomes with window start in [from,to] (Unix seconds)
+
+	exists,_ := g.S_db.CollectionExists(nil,BUDGET_COLLECTION)
+
+	if !exists {
+		return 0,0
+	}
+
+	querystring := "FOR doc IN " + BUDGET_COLLECTION + " FILTER doc.promise == @promise && doc.start >= @from && doc.start <= @to COLLECT AGGREGATE kept = SUM(doc.kept), total = SUM(doc.total) RETURN { kept: kept, total: total }"
+
+	bind := map[string]interface{}{ "promise": promise, "from": WindowStart(from*NANO), "to": to }
+
+	cursor,err := g.S_db.Query(nil,querystring,bind)
+
+	if err != nil {
+		fmt.Printf("Query \""+ querystring +"\" failed: %v", err)
+		return 0,0
+	}
+
+	defer cursor.Close()
+
+	var sum struct {
+		Kept  int64 `json:"kept"`
+		Total int64 `json:"total"`
+	}
+
+	_,err = cursor.ReadDocument(nil,&sum)
+
+	if err != nil && !A.IsNoMoreDocuments(err) {
+		fmt.Printf("Budget returned: %v", err)
+	}
+
+	return sum.Kept, sum.Total
+}
+
+// ****************************************************************************
+
+func ComputeBurnRate(window int64, kept, total int64, objective float64) BurnRate {
+
+	var b BurnRate
+
+	b.Window = window
+	b.Kept = kept
+	b.Total = total
+
+	if total == 0 || objective >= 1 {
+		return b
+	}
+
+	b.ErrorRate = float64(total-kept) / float64(total)
+	b.Burn = b.ErrorRate / (1 - objective)
+
+	return b
+}
+
+// ****************************************************************************
+
+func EvaluateErrorBudget(promise string, objective float64, period int64, kept, total int64, burns map[int64]BurnRate, warn_horizon float64) ErrorBudget {
+
+	// Pure part of the assessment, given windowed counts, so that it can be
+	// checked or replayed without a database
+
+	var eb ErrorBudget
+
+	eb.Promise = promise
+	eb.Objective = objective
+	eb.Period = period
+	eb.Kept = kept
+	eb.Total = total
+	eb.Remaining = 1
+	eb.TimeToExhaustion = math.Inf(1)
+
+	if total > 0 && objective < 1 {
+		allowed := (1 - objective) * float64(total)
+		eb.Remaining = 1 - float64(total-kept) / allowed
+	}
+
+	for _,a := range BURN_ALERTS {
+
+		long := burns[a.Long]
+		short := burns[a.Short]
+
+		if long.Burn > a.Threshold && short.Burn > a.Threshold {
+			eb.Alerts = AppendIfNew(eb.Alerts,a.Class)
+		}
+	}
+
+	// The shortest long window gives the current consumption rate; burning
+	// at rate b uses up the whole budget in period/b
+
+	current := burns[BURN_ALERTS[0].Long].Burn
+
+	if eb.Remaining <= 0 {
+
+		eb.TimeToExhaustion = 0
+		eb.Alerts = AppendIfNew(eb.Alerts,BUDGET_EXHAUSTED)
+
+	} else if current > 0 {
+
+		eb.TimeToExhaustion = eb.Remaining * float64(period) / current
+
+		if eb.TimeToExhaustion < warn_horizon {
+			eb.Alerts = AppendIfNew(eb.Alerts,BUDGET_EXHAUSTION_WARNING)
+		}
+	}
+
+	for w := range burns {
+		eb.BurnRates = append(eb.BurnRates,burns[w])
+	}
+
+	sort.Slice(eb.BurnRates, func(i, j int) bool {
+		return eb.BurnRates[i].Window < eb.BurnRates[j].Window
+	})
+
+	return eb
+}
+
+// ****************************************************************************
+
+func AssessErrorBudget(g Analytics, promise string, now int64) ErrorBudget {
+
+	// Compute the budget for a promise at time now (ns), using its policy
+	// objective, and raise the corresponding contexts, both generic and
+	// qualified by promise name, so that policy rules can react
+
+	policy := GetPromisePolicy(promise)
+	name := PromiseNameOf(promise)
+	secs := now / NANO
+
+	burns := make(map[int64]BurnRate)
+
+	for _,a := range BURN_ALERTS {
+
+		for _,window := range []int64{ a.Long, a.Short } {
+
+			if _,done := burns[window]; done {
+				continue
+			}
+
+			kept,total := GetBudgetWindow(g,name,secs-window,secs)
+			burns[window] = ComputeBurnRate(window,kept,total,policy.Objective)
+		}
+	}
+
+	kept,total := GetBudgetWindow(g,name,secs-policy.SLOPeriod,secs)
+
+	eb := EvaluateErrorBudget(name,policy.Objective,policy.SLOPeriod,kept,total,burns,policy.ExhaustionWarning)
+
+	for _,class := range eb.Alerts {
+
+		ContextAdd(class)
+		ContextAdd(ClassName(name) + "_" + class)
+	}
+
+	if len(eb.Alerts) > 0 {
+		fmt.Println("Error budget",name,"remaining",eb.Remaining,"time to exhaustion (s)",eb.TimeToExhaustion,eb.Alerts)
+	}
+
+	return eb
+}
+
+// ****************************************************************************
+
+func ClassName(s string) string {
+
+	// Context class names, CFEngine style, are identifiers
+
+	return strings.ReplaceAll(KeyName(s,0),"-","_")
+}
+
+// ****************************************************************************
+
+func AppendIfNew(list []string, s string) []string {
+
+	for i := range list {
+		if list[i] == s {
+			return list
+		}
+	}
+
+	return append(list,s)
+}
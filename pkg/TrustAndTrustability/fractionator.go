@@ -0,0 +1,885 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Fractionator - text into n-grams and intentional events, per instance
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ****************************************************************************
+// A Fractionator carries its own configuration (the leg window) and memory
+// (n-gram occurrences, selected events and counters), so several documents
+// can be analysed independently and concurrently, e.g.
+//
+//   f := TT.NewFractionator(TT.FractionationConfig{ LegWindow: 10 })
+//   topics := TT.FractionatorTextPrism(f,"subject",text)
+//
+// Fractionators that should learn from each other can share n-gram memory
+// (NewFractionatorWithMemory), but then must not run concurrently. The older
+// functions (FractionateSentences, RankByIntent, TextPrism, ...) are wrappers
+// around the default fractionator, whose config and memory are still the
+// package globals LEG_WINDOW, STM_NGRAM_RANK, LEG_SELECTIONS, KEPT, etc.
+// ****************************************************************************
+
+type FractionationConfig struct {
+
+	LegWindow int    `json:"leg_window"`  // sentences per leg
+	AutoLegWindow bool `json:"auto_leg_window"` // estimate LegWindow for each text, see EstimateLegWindow
+	Language  string `json:"language"`    // a language pack, LANGUAGE_AUTO, or "" for FORBIDDEN_*
+	Tokenizer string `json:"tokenizer"`   // TOKENIZER_WORDS, TOKENIZER_CJK or registered, "" = the language's
+	Work      string `json:"work"`        // WORK_LENGTH, WORK_STROKES or registered, "" = the language's
+	Segmenter string `json:"segmenter"`   // SEGMENTER_PUNCTUATION, SEGMENTER_RULES or registered
+
+	// Tuning, for parameter sweeps. Zero means the default, see CheckFractionationConfig,
+	// unless it was set with SetFractionationParam
+
+	MeaningThreshold float64 `json:"meaning_threshold"`  // least rank of a selected sentence, e.g. MEANING_THRESH
+	IntentCutoff     float64 `json:"intent_cutoff"`      // least intent of a topic n-gram
+	MinimumFrequency float64 `json:"minimum_frequency"`  // occurrences before an n-gram has intent
+	MinimumWork      float64 `json:"minimum_work"`       // work before an n-gram has intent
+	Forget           float64 `json:"forget"`             // fraction of n-gram memory forgotten per sentence, in streams
+	MinRecurrence    float64 `json:"min_recurrence"`     // least average spacing of a topic's occurrences, in sentences
+	MaxRecurrence    float64 `json:"max_recurrence"`     // greatest, in legs
+
+	explicit uint  // tuning parameters set by SetFractionationParam, whose zero is a value, not the default
+}
+
+// ****************************************************************************
+
+type Fractionator struct {
+
+	Config        FractionationConfig
+	Pack          *LanguagePack  // from Config.Language, or detected in the text
+	LegEstimate   *LegEstimate   // how the last text's leg window was chosen, with AutoLegWindow
+
+	STM           [MAXCLUSTERS]map[string]float64  // n-gram occurrences, learned across documents
+	Selections    []string                         // events selected, leg by leg
+
+	WordCount     int
+	LegCount      int
+	Kept          int
+	SentenceIndex int   // sentences seen, across documents
+}
+
+// ****************************************************************************
+
+var FRACTIONATOR = &Fractionator{ Config: DefaultFractionationConfig() }
+
+// The tuning parameters by JSON name, in the order of their explicit bits
+
+var FRACTIONATION_PARAMS = []string{ "meaning_threshold", "intent_cutoff", "minimum_frequency", "minimum_work", "forget", "min_recurrence", "max_recurrence" }
+
+// ****************************************************************************
+
+func DefaultFractionationConfig() FractionationConfig {
+
+	return FractionationConfig{
+		LegWindow: 100,
+		IntentCutoff: LOWEST_INTENT_CUTOFF,
+		MinimumFrequency: MINIMUM_FREQ_CUTOFF,
+		MinimumWork: MINIMUM_WORK,
+		Forget: FORGET_FRACTION,
+		MinRecurrence: MIN_RECURRENCE,
+		MaxRecurrence: MAX_RECURRENCE_LEGS,
+	}
+}
+
+// ****************************************************************************
+
+func CheckFractionationConfig(config FractionationConfig) (FractionationConfig,error) {
+
+	// Fill in defaults for zero values, and replace any that make no sense
+	// with the default too, returning an error that says which
+
+	var problems []string
+
+	d := DefaultFractionationConfig()
+
+	check := func(name string, v *float64, def float64, ok bool) {
+
+		if *v == 0 && config.explicit & FractionationParamBit(name) == 0 {
+			*v = def
+		} else if !ok {
+			problems = append(problems,fmt.Sprintf("%s %v",name,*v))
+			*v = def
+		}
+	}
+
+	if config.LegWindow < 1 {
+		config.LegWindow = d.LegWindow
+	}
+
+	check("meaning_threshold",&config.MeaningThreshold,d.MeaningThreshold,config.MeaningThreshold >= 0)
+	check("intent_cutoff",&config.IntentCutoff,d.IntentCutoff,config.IntentCutoff >= 0)
+	check("minimum_frequency",&config.MinimumFrequency,d.MinimumFrequency,config.MinimumFrequency >= 0)
+	check("minimum_work",&config.MinimumWork,d.MinimumWork,config.MinimumWork >= 0)
+	check("forget",&config.Forget,d.Forget,config.Forget > 0 && config.Forget < 1)
+	check("min_recurrence",&config.MinRecurrence,d.MinRecurrence,config.MinRecurrence >= 0)
+	check("max_recurrence",&config.MaxRecurrence,d.MaxRecurrence,config.MaxRecurrence > 0)
+
+	if config.MinRecurrence >= config.MaxRecurrence * float64(config.LegWindow) {
+		problems = append(problems,fmt.Sprintf("min_recurrence %v is not less than max_recurrence %v legs of %d",config.MinRecurrence,config.MaxRecurrence,config.LegWindow))
+		config.MinRecurrence = d.MinRecurrence
+		config.MaxRecurrence = d.MaxRecurrence
+	}
+
+	if len(problems) > 0 {
+		return config, fmt.Errorf("fractionation config: bad %s",strings.Join(problems,", "))
+	}
+
+	return config, nil
+}
+
+// ****************************************************************************
+
+func FractionationParamBit(name string) uint {
+
+	for i,param := range FRACTIONATION_PARAMS {
+		if param == name {
+			return 1 << i
+		}
+	}
+
+	return 0
+}
+
+// ****************************************************************************
+
+func NewFractionator(config FractionationConfig) *Fractionator {
+
+	var stm [MAXCLUSTERS]map[string]float64
+
+	for n := 1; n < MAXCLUSTERS; n++ {
+		stm[n] = make(map[string]float64)
+	}
+
+	return NewFractionatorWithMemory(config,stm)
+}
+
+// ****************************************************************************
+
+func NewFractionatorWithMemory(config FractionationConfig, stm [MAXCLUSTERS]map[string]float64) *Fractionator {
+
+	config, err := CheckFractionationConfig(config)
+
+	if err != nil {
+		fmt.Println(err,"(using the defaults)")
+	}
+
+	f := &Fractionator{ Config: config, STM: stm }
+
+	if config.Language != "" && config.Language != LANGUAGE_AUTO {
+
+		f.Pack = LanguagePackNamed(config.Language)
+
+		if f.Pack == nil {
+			fmt.Println("No language pack for",config.Language,"using",LANGUAGE_DEFAULT)
+			f.Pack = LanguagePackNamed(LANGUAGE_DEFAULT)
+		}
+	}
+
+	return f
+}
+
+// ****************************************************************************
+
+func FractionatorLanguage(f *Fractionator) string {
+
+	if f.Pack == nil {
+		return f.Config.Language
+	}
+
+	return f.Pack.Language
+}
+
+// ****************************************************************************
+
+func FractionatorDetectLanguage(f *Fractionator, text string) {
+
+	// With LANGUAGE_AUTO, choose the pack for this text
+
+	if f.Config.Language == LANGUAGE_AUTO {
+		f.Pack = LanguagePackNamed(DetectLanguage(text))
+	}
+}
+
+// ****************************************************************************
+
+func FractionatorCleanText(f *Fractionator, content string) string {
+
+	// CleanText with the fractionator's language pack. With LANGUAGE_AUTO,
+	// the first text decides the language, e.g. for a stream
+
+	if f.Pack == nil {
+		FractionatorDetectLanguage(f,content)
+	}
+
+	return CleanTextWith(content,f.Pack,FractionatorSegmenter(f))
+}
+
+// ****************************************************************************
+
+func FractionatorSegmenter(f *Fractionator) Segmenter {
+
+	if f.Config.Segmenter == "" {
+		return DefaultSegmenter(f.Pack)
+	}
+
+	return SegmenterNamed(f.Config.Segmenter)
+}
+
+// ****************************************************************************
+
+func FractionatorWork(f *Fractionator) WorkMeasure {
+
+	if f.Config.Work == "" && f.Pack != nil {
+		return WorkMeasureNamed(f.Pack.Work)
+	}
+
+	return WorkMeasureNamed(f.Config.Work)
+}
+
+// ****************************************************************************
+
+func FractionatorTokenizer(f *Fractionator) Tokenizer {
+
+	if f.Config.Tokenizer == "" && f.Pack != nil {
+		return TokenizerNamed(f.Pack.Tokenizer)
+	}
+
+	return TokenizerNamed(f.Config.Tokenizer)
+}
+
+// ****************************************************************************
+
+func DefaultFractionator() *Fractionator {
+
+	// The default fractionator takes its config and memory from the
+	// package globals, for the older API
+
+	f := FRACTIONATOR
+
+	if STM_NGRAM_RANK[1] == nil {
+		for n := 1; n < MAXCLUSTERS; n++ {
+			STM_NGRAM_RANK[n] = make(map[string]float64)
+		}
+	}
+
+	f.Config.LegWindow = LEG_WINDOW
+	f.STM = STM_NGRAM_RANK
+	f.Selections = LEG_SELECTIONS
+	f.WordCount = WORDCOUNT
+	f.LegCount = LEGCOUNT
+	f.Kept = KEPT
+	f.SentenceIndex = ALL_SENTENCE_INDEX
+
+	return f
+}
+
+// ****************************************************************************
+
+func SaveDefaultFractionator(f *Fractionator) {
+
+	// ...and hands back what it learned
+
+	LEG_SELECTIONS = f.Selections
+	WORDCOUNT = f.WordCount
+	LEGCOUNT = f.LegCount
+	KEPT = f.Kept
+	ALL_SENTENCE_INDEX = f.SentenceIndex
+}
+
+// ****************************************************************************
+
+func FractionatorTextPrism(f *Fractionator, subject, text string) PrismResult {
+
+	f.Selections = make([]string,0)
+
+	words := f.WordCount
+
+	selected,ltm := FractionatorSentences(f,text)
+	legs,events := FractionatorReviewAndSelectEvents(f,subject,selected)
+	pagetopics := FractionatorRankByIntent(f,selected,ltm)
+
+	result := MakePrismResult(subject,f.Config,len(selected),f.WordCount - words,legs,events,LongitudinalPersistentConcepts(pagetopics))
+	result.Language = FractionatorLanguage(f)
+
+	if f.Config.AutoLegWindow {
+		result.LegEstimate = f.LegEstimate
+	}
+
+	return result
+}
+
+// ****************************************************************************
+
+func FractionatorText2Ngrams(f *Fractionator, text string) [MAXCLUSTERS]map[string]float64 {
+
+	// Wrapper around simple text fractionator to return ngram map structure
+	// taking n-gram intentionality measures from the fractionator's
+	// cumulative cross learning map. Raw, no sub-selection of text.
+
+	var ngrams [MAXCLUSTERS]map[string]float64
+
+	difftext_2 := strings.ReplaceAll(text,"\n","")
+	difftext_1 := strings.ReplaceAll(difftext_2,"[","")
+	difftext_0 := strings.ReplaceAll(difftext_1,"]","")
+
+	search := "\\[[0-9]+"
+
+	r := regexp.MustCompile(search)
+	tmp := r.ReplaceAllString(difftext_0,"")
+	cleantext := strings.TrimSpace(tmp)
+	_,ltm := FractionatorSentences(f,cleantext)
+
+	for n := 1; n < MAXCLUSTERS; n++ {
+		ngrams[n] = make(map[string]float64)
+
+		for t := range ltm[n] {
+			ngrams[n][t] = f.STM[n][t]
+		}
+	}
+
+	return ngrams
+}
+
+//**************************************************************
+
+func FractionatorSentences(f *Fractionator, text string) ([]Narrative,[MAXCLUSTERS]map[string][]int) {
+
+	// Take a text as a single string and break into sentences.
+	// Return a time series of sub-selected Narrative structures of the highest
+	// Intentionality sentences (most "suspicious" or highest effort)
+	// along with an ltm (long term memory) frequency map of every occurrence
+	// by sentence number
+
+	var sentences []string
+	var selected_sentences []Narrative
+	var ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int
+
+	for i := 1; i < MAXCLUSTERS; i++ {
+		ltm_every_ngram_occurrence[i] = make(map[string][]int)
+	}
+
+	if len(text) == 0 {
+		return selected_sentences, ltm_every_ngram_occurrence
+	}
+
+	FractionatorDetectLanguage(f,text)
+
+	sentences = SplitIntoSentences(text)
+
+	if f.Config.AutoLegWindow {
+		FractionatorEstimateLegWindow(f,sentences)
+	}
+
+	var meaning = make([]float64,len(sentences))
+
+	for s_idx := range sentences {
+
+		meaning[s_idx] = FractionatorRankSentence(f,s_idx,sentences[s_idx],len(sentences),ltm_every_ngram_occurrence)
+	}
+
+	// Some things to note: importance tends to be clustered around the start and the end of
+	// a story. The start is automatically weakner in this method, due to lack of data. We can
+	// compensate by weighting the start and the end by sentence number.
+
+	midway := len(sentences) / 2
+
+	for s_idx := range sentences {
+
+		scale_factor := 1.0 + float64((midway - s_idx) * (midway - s_idx)) / float64(midway*midway)
+
+		n := NarrationMarker(sentences[s_idx], meaning[s_idx] * scale_factor, s_idx)
+
+		selected_sentences = append(selected_sentences,n)
+
+		f.SentenceIndex++
+	}
+
+	return selected_sentences, ltm_every_ngram_occurrence
+}
+
+//**************************************************************
+
+func FractionatorRankSentence(f *Fractionator, s_idx int, sentence string, total_sentences int,ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int) float64 {
+
+	// A round robin cyclic buffer for taking fragments and extracting
+	// n-ngrams of 1,2,3,4,5,6 words (or characters, by the tokenizer), passing
+
+	var rrbuffer [MAXCLUSTERS][]string
+	var sentence_meaning_rank float64 = 0
+	var rank float64
+
+	// split sentence on any residual punctuation here, because punctuation cannot be in the middle
+	// of an n-gram by definition of punctuation's promises, and we are not interested in word groups
+	// that unintentionally straddle punctuation markers, since they are false signals
+
+	re := regexp.MustCompile("[,.;:!?]")
+	sentence_frags := re.Split(sentence, -1)
+
+	tokenizer := FractionatorTokenizer(f)
+
+	for frag := range sentence_frags {
+
+		// For one sentence, break it up into codons and sum their importances
+
+		for _,cleanword := range tokenizer.Tokens(sentence_frags[frag]) {
+
+			f.WordCount++
+
+			// Shift all the rolling longitudinal Ngram rr-buffers by one word
+
+			rank, rrbuffer = FractionatorNextWord(f,s_idx,cleanword,rrbuffer,total_sentences,ltm_every_ngram_occurrence)
+			sentence_meaning_rank += rank
+		}
+	}
+
+	return sentence_meaning_rank
+}
+
+//**************************************************************
+
+func FractionatorNextWord(f *Fractionator, s_idx int, word string, rrbuffer [MAXCLUSTERS][]string,total_sentences int,ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int) (float64,[MAXCLUSTERS][]string) {
+
+	// Word by word, we form a superposition of scores from n-grams of different lengths
+	// as a simple sum. This means lower lengths will dominate as there are more of them
+	// so we define intentionality proportional to the length also as compensation
+
+	var rank float64 = 0
+
+	for n := 2; n < MAXCLUSTERS; n++ {
+
+		// Pop from round-robin
+
+		if (len(rrbuffer[n]) > n-1) {
+			rrbuffer[n] = rrbuffer[n][1:n]
+		}
+
+		// Push new to maintain length
+
+		rrbuffer[n] = append(rrbuffer[n],word)
+
+		// Assemble the key, only if complete cluster
+
+		if (len(rrbuffer[n]) > n-1) {
+
+			key := NgramKey(rrbuffer[n])
+
+			if ExcludedByPack(f.Pack,rrbuffer[n][0],rrbuffer[n][n-1]) {
+
+				continue
+			}
+
+			f.STM[n][key]++
+			rank += FractionatorIntentionality(f,n,key,total_sentences)
+
+			ltm_every_ngram_occurrence[n][key] = append(ltm_every_ngram_occurrence[n][key],s_idx)
+
+		}
+	}
+
+	f.STM[1][word]++
+	rank += FractionatorIntentionality(f,1,word,total_sentences)
+
+	ltm_every_ngram_occurrence[1][word] = append(ltm_every_ngram_occurrence[1][word],s_idx)
+
+	return rank, rrbuffer
+}
+
+//**************************************************************
+
+func FractionatorIntentionality(f *Fractionator, n int, s string, sentence_count int) float64 {
+
+	// Compute the effective intent of a string s at a position count
+	// within a document of many sentences. The weighting due to
+	// inband learning uses an exponential deprecation based on
+	// SST scales (see "leg" meaning).
+
+	occurrences := f.STM[n][s]
+	work := FractionatorWork(f)(s)
+	legs := float64(sentence_count) / float64(f.Config.LegWindow)
+
+	if occurrences < f.Config.MinimumFrequency {
+		return 0
+	}
+
+	if work < f.Config.MinimumWork {
+		return 0
+	}
+
+	// lambda should have a cutoff for insignificant words, like "a" , "of", etc that occur most often
+
+	lambda := occurrences / float64(f.Config.LegWindow)
+
+	// This constant is tuned to give words a growing importance up to a limit
+	// or peak occurrences, then downgrade
+
+	// Things that are repeated too often are not important
+	// but length indicates purposeful intent
+
+	meaning := lambda * work / (1.0 + math.Exp(lambda-legs))
+
+	return meaning
+}
+
+//**************************************************************
+
+func FractionatorRankByIntent(f *Fractionator, selected_sentences []Narrative,ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int) map[string]float64 {
+
+	// Analyse the sub-selected narrative array structure and select phrases with
+	// top ranking intentionality, looking for a radius of repetition in the text
+	// as a sign of longitudinal persistence of concept. This assumes that phrases
+	// that are repeated in clusters throughout a text will be associated with concepts
+	// important to the text, i.e. strongly intended meaning in terms of work done
+
+	return FractionatorRankNgrams(f,len(selected_sentences),ltm_every_ngram_occurrence)
+}
+
+// *****************************************************************
+
+func FractionatorRankNgrams(f *Fractionator, sentences int, ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int) map[string]float64 {
+
+	var topics = make(map[string]float64)
+
+	for n := 1; n < MAXCLUSTERS; n++ {
+
+		// Search through all sentence ngrams and measure distance between repeated
+		// try to indentify any scales that emerge
+
+		for ngram := range ltm_every_ngram_occurrence[n] {
+
+			intent := FractionatorIntentionality(f,n,ngram,sentences)
+
+			if intent < f.Config.IntentCutoff  {
+				continue
+			}
+
+			// which ngrams occur in bursty clusters. If completely even, then significance
+			// is low or the theme of the whole piece. If cluster span/total span
+			// max interdistance >> min interdistance then bursty
+
+			min_delta,_,av_delta := NgramSpacing(ltm_every_ngram_occurrence[n][ngram])
+
+			if min_delta == 0 {
+				continue
+			}
+
+			if (av_delta > f.Config.MinRecurrence) && (av_delta < float64(f.Config.LegWindow) * f.Config.MaxRecurrence) {
+
+				topics[ngram] = intent
+			}
+		}
+	}
+
+	return topics
+}
+
+// ****************************************************************************
+
+func NgramSpacing(occurrences []int) (int,int,float64) {
+
+	// The least, greatest and average gaps between the sentences of an n-gram's
+	// occurrences, the first measured from the start of the text
+
+	var last,delta int
+
+	var min_delta int = 9999
+	var max_delta int = 0
+	var sum_delta int = 0
+
+	for location := 0; location < len(occurrences); location++ {
+
+		// Foreach occurrence, check proximity to others
+		// This is about seeing if an ngram is a recurring input in the stream.
+		// Does the subject recur several times over some scale? The scale may be
+		// logarithmic like n / log (o1-o2) for occurrence separation
+		// Radius = 100 sentences, how many occurrences of this ngram close together?
+
+		// Does meaning have an intrinsic radius? It doesn't make sense that it
+		// depends on the length of the document. How could we measure this?
+
+		// two one relative to first occurrence (absolute range), one to last occurrence??
+		// only the last is invariant on the scale of a story
+
+		delta = occurrences[location] - last
+		last = occurrences[location]
+
+		sum_delta += delta
+
+		if min_delta > delta {
+			min_delta = delta
+		}
+
+		if max_delta < delta {
+			max_delta = delta
+		}
+	}
+
+	if len(occurrences) == 0 {
+		return 0, 0, 0
+	}
+
+	return min_delta, max_delta, float64(sum_delta)/float64(len(occurrences))
+}
+
+// *****************************************************************
+
+func FractionatorReviewAndSelectEvents(f *Fractionator, filename string, selected_sentences []Narrative) ([]PrismLeg,[]PrismEvent) {
+
+	// The importances have now all been measured in realtime, but we review them now...posthoc
+	// Now go through the history map chronologically, by sentence only reset the narrative
+        // `leg' counter when it fills up to measure story progress.
+	// This determines the sampling density of "important sentences" - pick a few from each leg
+
+	Println(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>")
+	Println("> Select inferred intentional content summary ...about",filename)
+	Println(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>")
+
+	var steps,leg int
+	var legs []PrismLeg
+	var events []PrismEvent
+
+	leg_window := f.Config.LegWindow
+
+	// Sentences to summarize per leg of the story journey
+
+	steps = 0
+
+	// We rank a leg by summing its sentence ranks
+
+	var rank_sum float64 = 0
+	var av_rank_for_leg []float64
+
+	// First, coarse grain the narrative into `legs',
+        // i.e. standardized "narrative regions" by meter not syntax
+
+	for s := range selected_sentences {
+
+		// Make list of summed importance ranks for each leg
+
+		rank_sum += selected_sentences[s].rank
+
+		// Once we've summed all the importances and reached the end of the leg
+		// define the leg_rank_average as the average over the interval and add this
+		// to a list/array indexed by legs sequentially (append)
+
+		if steps > leg_window {
+
+			steps = 0
+			leg_rank_average := rank_sum / float64(leg_window)
+			av_rank_for_leg = append(av_rank_for_leg,leg_rank_average)
+			rank_sum = 0
+		}
+
+		steps++
+	}
+
+	// Don't forget any final "short" leg if there is one (residuals from the loop < leg_window)
+
+	leg_rank_average := rank_sum / float64(steps)
+	av_rank_for_leg = append(av_rank_for_leg,leg_rank_average)
+
+	// Find the leg of maximum importance
+
+	var max_all_legs float64 = 0
+
+	for l := range av_rank_for_leg {
+
+		if max_all_legs < av_rank_for_leg[l] {
+
+			max_all_legs = av_rank_for_leg[l]
+		}
+	}
+
+	// Select a sampling rate that's lazy (> 1 sentence per leg) or busy ( <a few)
+	// for important legs
+
+	steps = 0
+	leg = 0
+	var this_leg_av_rank float64 = av_rank_for_leg[0]
+
+	var sentence_id_by_rank = make(map[int]map[float64]int)
+	sentence_id_by_rank[0] = make(map[float64]int)
+
+	// Go through all the sentences that haven't been excluded and pick a sampling density that's
+	// approximately evenly distributed-- split into leg_window intervals
+
+	for s := range selected_sentences {
+
+		sentence_id_by_rank[leg][selected_sentences[s].rank] = s
+
+		if steps > leg_window {
+
+			this_leg_av_rank = av_rank_for_leg[leg]
+
+			// At the start of a long doc, there's insufficient weight to make an impact, so
+			// we need to compensate by some arbitrary amount, this needs to be replaced by a ratio?
+			// Based on word density...
+
+			leg_summary,leg_events := FractionatorAnnotateLeg(f, filename, selected_sentences, leg, sentence_id_by_rank[leg], this_leg_av_rank, max_all_legs)
+			legs,events = AppendPrismLeg(legs,events,leg_summary,leg_events)
+
+			steps = 0
+			leg++
+
+			sentence_id_by_rank[leg] = make(map[float64]int)
+		}
+
+		steps++
+	}
+
+	// Don't forget the final remainder (catch leg++)
+
+	this_leg_av_rank = av_rank_for_leg[leg]
+
+	leg_summary,leg_events := FractionatorAnnotateLeg(f, filename, selected_sentences, leg, sentence_id_by_rank[leg], this_leg_av_rank, max_all_legs)
+	legs,events = AppendPrismLeg(legs,events,leg_summary,leg_events)
+
+	// Summarize
+
+	Println("------------------------------------------")
+	Println("Notable events = ",f.Kept,"of total ",f.SentenceIndex,"efficiency = ",100*float64(f.SentenceIndex)/float64(f.Kept),"%")
+	Println("------------------------------------------\n")
+
+	return legs,events
+}
+
+//**************************************************************
+
+func FractionatorAnnotateLeg(f *Fractionator, filename string, selected_sentences []Narrative, leg int, sentence_id_by_rank map[float64]int, this_leg_av_rank, max float64) (PrismLeg,[]PrismEvent) {
+
+	// For each quasi paragraph or "leg" of a document text, we expect a persistence
+	// of intent over the region (in other words, an inertia for talking about the same
+	// thing) analyse the Narrative subselections to skim off only the most important
+	// intentional sentences at a fixed rate per leg. This captures spacetime process at
+	// a fixed rate of reporting so that we don't hop over large parts of the text that
+	// are stylistcally different.
+
+	var sentence_ranks []float64
+	var ranks_in_order []int
+	var events []PrismEvent
+
+	key := make(map[float64]int)
+
+	for fl := range sentence_id_by_rank {
+
+		sentence_ranks = append(sentence_ranks,fl)
+	}
+
+	var samples_per_leg = len(sentence_ranks)
+
+	summary := PrismLeg{ Leg: leg, Candidates: samples_per_leg, AvRank: this_leg_av_rank }
+
+	if samples_per_leg < 1 {
+		return summary,nil
+	}
+
+	f.LegCount++
+
+	// Rank by importance and rescale all as dimensionless between [0,1]
+
+	sort.Float64s(sentence_ranks)
+	scale_free_trust := this_leg_av_rank / max
+
+	if max > 0 {
+		summary.RelativeRank = scale_free_trust
+	}
+
+	// We now have an array of sentences whose indices are ascending ordered rankings, max = last
+	// and an array of rankings min to max
+	// Set up a key = sentence with rank = r as key[r]
+
+	for i := range sentence_ranks {
+		key[sentence_ranks[i]] = sentence_id_by_rank[sentence_ranks[i]]
+	}
+
+	// Select only the most important remaining in order for the hub
+	// Hubs will overlap with each other, so some will be "near" others i.e. "approx" them
+	// We want the degree of overlap between hubs TT.CompareContexts()
+
+	Println("\n >> (Rank leg interest potential (anomalous intent)",leg,"=",scale_free_trust,")")
+
+	// How do we quantitatively adjust output rate/velocity based on above threshold deviation
+
+	var detail_per_leg_policy int
+
+	if scale_free_trust > 0 { // Always true (legacy)
+
+		var start int
+
+		// Scale processing velocity like sqrt of probable mistrust event rate per leg
+
+		detail_per_leg_policy = int(0.5 + math.Sqrt(float64(f.Config.LegWindow) * scale_free_trust))
+
+		summary.Velocity = detail_per_leg_policy
+
+		Println(" >> (Dynamic kinetic event selection velocity", detail_per_leg_policy,"(events per leg)",f.Config.LegWindow,")")
+
+		// top intra_leg_sampling_density = count backwards from the end
+
+		if samples_per_leg > detail_per_leg_policy {
+
+			start = len(sentence_ranks) - detail_per_leg_policy
+
+		} else {
+			start = 0
+		}
+
+		for i :=  start; i < len(sentence_ranks); i++ {
+
+			if sentence_ranks[i] < f.Config.MeaningThreshold {
+				continue
+			}
+
+			r := key[sentence_ranks[i]]
+			ranks_in_order = append(ranks_in_order,r)
+		}
+
+		// Put the ranked selections back in sentence order
+
+		sort.Ints(ranks_in_order)
+
+	}
+
+	// Now highest importance within the lef, in order of occurrence
+
+	for r := range ranks_in_order {
+
+		n := selected_sentences[ranks_in_order[r]]
+
+		Printf("\nEVENT[Leg %d selects %d]: %s\n",leg,ranks_in_order[r],n.text)
+		f.Selections = append(f.Selections,n.text)
+		f.Kept++
+
+		events = append(events,PrismEvent{ Sentence: n.index, Leg: leg, Rank: n.rank, Text: n.text })
+	}
+
+	summary.Selected = len(events)
+
+	return summary,events
+}
@@ -0,0 +1,299 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Language packs - binding words and sentence rules per language
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ****************************************************************************
+// The little domain knowledge the fractionator has is language specific:
+// words that bind to a neighbour and so can't start or end an n-gram, the
+// abbreviations whose full stop doesn't end a sentence, and any terminators
+// peculiar to the language (e.g. the Greek question mark looks like ";").
+// A pack is a JSON file, e.g.
+//
+// {
+//   "language": "de",
+//   "script": "Latin",
+//   "starters": ["und","oder","der","die","das"],
+//   "endings": ["und","oder","der","die","das","ein","eine"],
+//   "abbreviations": ["z.b.","d.h.","usw.","dr."],
+//   "terminators": {},
+//   "tokenizer": "words",
+//   "work": "length"
+// }
+//
+// Packs for English (en) and Chinese (zh, no bindings, per character
+// tokens, work in brush strokes) are built in. A fractionator uses the pack named in its config,
+// or with "auto" the one DetectLanguage picks for each text. With no
+// language it uses FORBIDDEN_STARTER and FORBIDDEN_ENDING as before.
+// ****************************************************************************
+
+const LANGUAGE_AUTO = "auto"
+const LANGUAGE_DEFAULT = "en"
+const LANGUAGE_DETECT_BYTES = 32*1024  // of text sampled by DetectLanguage
+
+// ****************************************************************************
+
+type LanguagePack struct {
+
+	Language      string            `json:"language"`
+	Script        string            `json:"script"`        // as in unicode.Scripts, e.g. Latin, Greek, Han
+	Starters      []string          `json:"starters"`      // can't start an n-gram
+	Endings       []string          `json:"endings"`       // can't end an n-gram
+	Abbreviations []string          `json:"abbreviations"` // lower case, with their full stops
+	Terminators   map[string]string `json:"terminators"`   // extra sentence ends, rune -> . ! or ?
+	Tokenizer     string            `json:"tokenizer"`     // "" = TOKENIZER_WORDS
+	Work          string            `json:"work"`          // "" = WORK_LENGTH
+
+	starters      map[string]bool
+	endings       map[string]bool
+	abbreviations map[string]bool
+	terminators   map[rune]string
+}
+
+// ****************************************************************************
+
+var LANGUAGE_PACKS = map[string]*LanguagePack{}
+
+// ****************************************************************************
+
+func init() {
+
+	RegisterLanguagePack(LanguagePack{ Language: "en", Script: "Latin",
+		Starters: FORBIDDEN_STARTER,
+		Endings: FORBIDDEN_ENDING,
+		Abbreviations: []string{"mr.","mrs.","ms.","dr.","prof.","st.","e.g.","i.e.","vs.","cf.","fig.","approx.","jr.","sr.","inc.","ltd.","co."},
+	})
+
+	RegisterLanguagePack(LanguagePack{ Language: "zh", Script: "Han", Tokenizer: TOKENIZER_CJK, Work: WORK_STROKES })
+}
+
+// ****************************************************************************
+
+func RegisterLanguagePack(pack LanguagePack) (*LanguagePack,error) {
+
+	if pack.Language == "" || pack.Language == LANGUAGE_AUTO {
+		return nil, fmt.Errorf("language pack needs a language name, not \"%s\"",pack.Language)
+	}
+
+	if pack.Script != "" && unicode.Scripts[pack.Script] == nil {
+		return nil, fmt.Errorf("language pack %s: unknown script \"%s\"",pack.Language,pack.Script)
+	}
+
+	if _,ok := TOKENIZERS[pack.Tokenizer]; pack.Tokenizer != "" && !ok {
+		return nil, fmt.Errorf("language pack %s: unknown tokenizer \"%s\"",pack.Language,pack.Tokenizer)
+	}
+
+	if _,ok := WORK_MEASURES[pack.Work]; pack.Work != "" && !ok {
+		return nil, fmt.Errorf("language pack %s: unknown work measure \"%s\"",pack.Language,pack.Work)
+	}
+
+	p := &pack
+
+	p.starters = WordSet(p.Starters)
+	p.endings = WordSet(p.Endings)
+	p.abbreviations = WordSet(p.Abbreviations)
+	p.terminators = make(map[rune]string)
+
+	for r,mark := range p.Terminators {
+
+		if utf8.RuneCountInString(r) != 1 || !strings.Contains(".!?",mark) || len(mark) != 1 {
+			return nil, fmt.Errorf("language pack %s: terminator \"%s\" should be one character ending . ! or ?",p.Language,r)
+		}
+
+		c,_ := utf8.DecodeRuneInString(r)
+		p.terminators[c] = mark
+	}
+
+	LANGUAGE_PACKS[p.Language] = p
+
+	return p, nil
+}
+
+// ****************************************************************************
+
+func LoadLanguagePack(filename string) (*LanguagePack,error) {
+
+	var pack LanguagePack
+
+	content, err := os.ReadFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(content,&pack); err != nil {
+		return nil, fmt.Errorf("language pack %s: %v",filename,err)
+	}
+
+	return RegisterLanguagePack(pack)
+}
+
+// ****************************************************************************
+
+func LanguagePackNamed(language string) *LanguagePack {
+
+	// nil if there is no such pack
+
+	return LANGUAGE_PACKS[language]
+}
+
+// ****************************************************************************
+
+func WordSet(words []string) map[string]bool {
+
+	set := make(map[string]bool)
+
+	for _,w := range words {
+		set[strings.ToLower(w)] = true
+	}
+
+	return set
+}
+
+// ****************************************************************************
+
+func ExcludedByPack(pack *LanguagePack, firstword,lastword string) bool {
+
+	// As ExcludedByBindings, with the pack's binding words
+
+	if pack == nil {
+		return ExcludedByBindings(firstword,lastword)
+	}
+
+	if (len(firstword) == 1) || len(lastword) == 1 {
+		return true
+	}
+
+	return pack.endings[lastword] || pack.starters[firstword]
+}
+
+// ****************************************************************************
+
+func DetectLanguage(text string) string {
+
+	// A simple detector: find the script most of the letters are written
+	// in, then among the packs for that script, the one with most of its
+	// binding words in the text. Binding words are the commonest words of
+	// any language, so a few hundred words are usually enough
+
+	if len(text) > LANGUAGE_DETECT_BYTES {
+
+		cut := LANGUAGE_DETECT_BYTES
+
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+
+		text = text[:cut]
+	}
+
+	var names []string
+
+	letters := make(map[string]int)
+	candidates := make(map[string]bool)
+
+	for name,p := range LANGUAGE_PACKS {
+
+		names = append(names,name)
+
+		if p.Script != "" {
+			candidates[p.Script] = true
+		}
+	}
+
+	sort.Strings(names)
+
+	for _,r := range text {
+
+		if !unicode.IsLetter(r) {
+			continue
+		}
+
+		// Japanese kana count as Han for this purpose
+
+		if unicode.In(r,unicode.Hiragana,unicode.Katakana) {
+			letters["Han"]++
+			continue
+		}
+
+		for script := range candidates {
+			if unicode.Is(unicode.Scripts[script],r) {
+				letters[script]++
+				break
+			}
+		}
+	}
+
+	script := ""
+
+	for s,count := range letters {
+		if script == "" || count > letters[script] || (count == letters[script] && s < script) {
+			script = s
+		}
+	}
+
+	words := strings.Fields(strings.ToLower(text))
+
+	best := ""
+	best_score := -1
+
+	for _,name := range names {
+
+		p := LANGUAGE_PACKS[name]
+
+		if p.Script != script {
+			continue
+		}
+
+		score := 0
+
+		for _,w := range words {
+
+			w = strings.Trim(w,".,:;!?()#")
+
+			if p.starters[w] || p.endings[w] {
+				score++
+			}
+		}
+
+		if score > best_score || (score == best_score && name == LANGUAGE_DEFAULT) {
+			best = name
+			best_score = score
+		}
+	}
+
+	if best == "" {
+		return LANGUAGE_DEFAULT
+	}
+
+	return best
+}
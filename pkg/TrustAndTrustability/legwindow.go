@@ -0,0 +1,255 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Adaptive leg window - the scale of a leg, from the text itself
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"math"
+	"regexp"
+	"sort"
+)
+
+// ****************************************************************************
+// The leg window is the radius of a story's episodes, in sentences. A
+// Wikipedia article wants about 100, its edit history of short remarks
+// about 10, so a mixed corpus has to be tuned source by source. With
+// AutoLegWindow the fractionator estimates it for each text instead, e.g.
+//
+//   f := TT.NewFractionator(TT.FractionationConfig{ AutoLegWindow: true })
+//   result := TT.FractionatorTextPrism(f,"subject",text)
+//   fmt.Println(result.Config.LegWindow, result.LegEstimate)
+//
+// Phrases a text is about come back every so often, so the median gap between
+// successive occurrences of recurring n-grams says how long the text stays on
+// one subject; a leg spans about two such gaps. Texts whose sentence
+// lengths vary a lot are fragmented, like comments or edit histories, and
+// change subject faster, so the window shrinks by 1 + the coefficient of
+// variation of sentence length. Without recurrences, a text of N sentences
+// gets sqrt(N). The window is kept between MIN_LEG_WINDOW and a size that
+// gives at least MIN_LEGS legs.
+//
+// Streams can't see the text ahead, so they keep the configured LegWindow.
+// ****************************************************************************
+
+const MIN_LEG_WINDOW = 5  // sentences
+const MIN_LEGS = 3        // per text, unless it's shorter than that many least windows
+
+// ****************************************************************************
+
+type LegEstimate struct {
+
+	Sentences   int     `json:"sentences"`
+	MeanLength  float64 `json:"mean_length"`   // tokens per sentence
+	LengthCV    float64 `json:"length_cv"`     // standard deviation / mean
+	Recurring   int     `json:"recurring"`     // n-grams whose spacing was measured
+	Spacing     float64 `json:"spacing"`       // their median average gap, in sentences
+	LegWindow   int     `json:"leg_window"`    // the result
+}
+
+// ****************************************************************************
+
+func FractionatorEstimateLegWindow(f *Fractionator, sentences []string) int {
+
+	// Set the fractionator's leg window for these sentences, before they
+	// are ranked, since intentionality depends on it
+
+	var ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int
+
+	for n := 1; n < MAXCLUSTERS; n++ {
+		ltm_every_ngram_occurrence[n] = make(map[string][]int)
+	}
+
+	lengths := make([]int,len(sentences))
+
+	for s_idx := range sentences {
+		lengths[s_idx] = FractionatorSentenceNgrams(f,s_idx,sentences[s_idx],ltm_every_ngram_occurrence)
+	}
+
+	estimate := EstimateLegWindow(lengths,ltm_every_ngram_occurrence,f.Config.MinimumFrequency)
+
+	// The window must still leave room for a topic's recurrence
+
+	if f.Config.MinRecurrence >= f.Config.MaxRecurrence * float64(estimate.LegWindow) {
+		estimate.LegWindow = int(f.Config.MinRecurrence / f.Config.MaxRecurrence) + 1
+	}
+
+	f.Config.LegWindow = estimate.LegWindow
+	f.LegEstimate = &estimate
+
+	Printf("Leg window %d for %d sentences (spacing %.1f, length %.1f cv %.2f)\n",estimate.LegWindow,estimate.Sentences,estimate.Spacing,estimate.MeanLength,estimate.LengthCV)
+
+	return estimate.LegWindow
+}
+
+// ****************************************************************************
+
+func FractionatorSentenceNgrams(f *Fractionator, s_idx int, sentence string, ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int) int {
+
+	// Record where the n-grams of a sentence occur, as FractionatorRankSentence
+	// does, but without learning or ranking them. Returns the number of tokens
+
+	var rrbuffer [MAXCLUSTERS][]string
+	var tokens int
+
+	re := regexp.MustCompile("[,.;:!?]")
+	tokenizer := FractionatorTokenizer(f)
+
+	for _,frag := range re.Split(sentence,-1) {
+
+		for _,word := range tokenizer.Tokens(frag) {
+
+			tokens++
+
+			for n := 2; n < MAXCLUSTERS; n++ {
+
+				if len(rrbuffer[n]) > n-1 {
+					rrbuffer[n] = rrbuffer[n][1:n]
+				}
+
+				rrbuffer[n] = append(rrbuffer[n],word)
+
+				if len(rrbuffer[n]) > n-1 && !ExcludedByPack(f.Pack,rrbuffer[n][0],rrbuffer[n][n-1]) {
+
+					key := NgramKey(rrbuffer[n])
+					ltm_every_ngram_occurrence[n][key] = append(ltm_every_ngram_occurrence[n][key],s_idx)
+				}
+			}
+
+			ltm_every_ngram_occurrence[1][word] = append(ltm_every_ngram_occurrence[1][word],s_idx)
+		}
+	}
+
+	return tokens
+}
+
+// ****************************************************************************
+
+func EstimateLegWindow(lengths []int, ltm_every_ngram_occurrence [MAXCLUSTERS]map[string][]int, minimum_frequency float64) LegEstimate {
+
+	// From the tokens in each sentence and where the n-grams occur.
+	// Single words are only used if no longer n-gram recurs, as the
+	// commonest words recur in nearly every sentence
+
+	var e LegEstimate
+
+	e.Sentences = len(lengths)
+
+	if e.Sentences == 0 {
+		e.LegWindow = MIN_LEG_WINDOW
+		return e
+	}
+
+	var sum, sumsq float64
+
+	for _,l := range lengths {
+		sum += float64(l)
+		sumsq += float64(l*l)
+	}
+
+	e.MeanLength = sum / float64(e.Sentences)
+
+	if e.MeanLength > 0 {
+		variance := sumsq / float64(e.Sentences) - e.MeanLength * e.MeanLength
+		e.LengthCV = math.Sqrt(math.Max(variance,0)) / e.MeanLength
+	}
+
+	var spacings []float64
+
+	for n := 2; n < MAXCLUSTERS; n++ {
+		spacings = append(spacings,RecurrenceSpacings(ltm_every_ngram_occurrence[n],minimum_frequency)...)
+	}
+
+	if len(spacings) == 0 {
+		spacings = RecurrenceSpacings(ltm_every_ngram_occurrence[1],minimum_frequency)
+	}
+
+	var window float64
+
+	if len(spacings) > 0 {
+
+		sort.Float64s(spacings)
+
+		e.Recurring = len(spacings)
+		e.Spacing = spacings[len(spacings)/2]
+
+		window = 2 * e.Spacing / (1 + e.LengthCV)
+
+	} else {
+		window = math.Sqrt(float64(e.Sentences))
+	}
+
+	most := e.Sentences / MIN_LEGS
+
+	if most < MIN_LEG_WINDOW {
+		most = MIN_LEG_WINDOW
+	}
+
+	e.LegWindow = int(math.Round(window))
+
+	if e.LegWindow < MIN_LEG_WINDOW {
+		e.LegWindow = MIN_LEG_WINDOW
+	}
+
+	if e.LegWindow > most {
+		e.LegWindow = most
+	}
+
+	return e
+}
+
+// ****************************************************************************
+
+func RecurrenceSpacings(occurrences map[string][]int, minimum_frequency float64) []float64 {
+
+	// Average gaps between successive sentences of the n-grams that recur.
+	// Unlike NgramSpacing (for RankByIntent), the first gap is not measured
+	// from the start of the text, as that is where an n-gram is, not how often
+	// it comes back; repeats within a sentence are one occurrence
+
+	var spacings []float64
+
+	for _,sentences := range occurrences {
+
+		if float64(len(sentences)) < minimum_frequency {
+			continue
+		}
+
+		distinct := 1
+
+		for i := 1; i < len(sentences); i++ {
+			if sentences[i] != sentences[i-1] {
+				distinct++
+			}
+		}
+
+		if distinct < 2 {
+			continue
+		}
+
+		first := sentences[0]
+		last := sentences[len(sentences)-1]
+
+		spacings = append(spacings,float64(last - first) / float64(distinct - 1))
+	}
+
+	return spacings
+}
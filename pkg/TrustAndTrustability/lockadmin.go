@@ -0,0 +1,511 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Inspection and cleanup of service locks
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// ****************************************************************************
+// When agents crash they leave lock.* (running) and last.* (completed) records
+// behind. Each record is judged by the same promise policy (ifelapsed,
+// expireafter) and staleness rules that BeginService uses, so what we call
+// stale here is exactly what the next BeginService would break anyway.
+//
+// Older versions kept empty lock.<name> and last.<name> files directly in
+// /tmp, timed by their modification times. A LegacyLockDir lists those, and
+// removes only named files that belong to us; it is never used to take locks,
+// since anyone can write there.
+// ****************************************************************************
+
+const LEGACY_LOCKDIR = "/tmp"
+
+// ****************************************************************************
+
+type LockLister interface {
+
+	// The inspection half of a Locker
+
+	List() ([]LockRecord,error)
+	Remove(rec LockRecord, running,last bool) error
+}
+
+// ****************************************************************************
+
+type LegacyLockDir struct {
+
+	Dir string
+}
+
+type LockRecord struct {
+
+	Name      string
+	This      string      // running lock file (or key), "" if not running
+	Last      string      // last completed marker, "" if none
+	Holder    LockOwner   // owner of the running lock
+	Completed int64       // ns, when last completed, 0 = never
+	Foreign   bool        // legacy files of another user, listed but never removed
+}
+
+// ****************************************************************************
+
+type LockStatus struct {
+
+	LockRecord
+
+	IfElapsed     int64    // from the promise policy
+	ExpireAfter   int64
+
+	Running       bool
+	RunningFor    float64  // seconds
+	SinceLast     float64  // seconds since last completed, -1 = never
+	OwnerAlive    bool
+	Expired       bool     // running longer than expireafter
+	Stale         bool     // running, but would be broken by the next BeginService
+	TooSoon       bool     // a new BeginService would still be refused by ifelapsed
+}
+
+// ****************************************************************************
+
+type LockCleanup struct {
+
+	Name   string
+	Action string   // LOCK_EXPIRED or LOCK_FORGOTTEN
+	Error  error
+}
+
+const LOCK_EXPIRED = "expired"     // running lock removed
+const LOCK_FORGOTTEN = "forgotten" // last completed marker removed, no longer restricts anything
+
+// ****************************************************************************
+
+func AssessLock(rec LockRecord, now int64) LockStatus {
+
+	var s LockStatus
+
+	policy := GetPromisePolicy(rec.Name)
+
+	s.LockRecord = rec
+	s.IfElapsed = policy.IfElapsed
+	s.ExpireAfter = policy.ExpireAfter
+	s.SinceLast = -1
+
+	if rec.Completed != NEVER {
+		s.SinceLast = float64(now - rec.Completed) / NANO
+		s.TooSoon = (now - rec.Completed) / NANO < policy.IfElapsed
+	}
+
+	if rec.This != "" {
+		s.Running = true
+		s.RunningFor = float64(now - rec.Holder.Start) / NANO
+		s.Expired = (now - rec.Holder.Start) / NANO > policy.ExpireAfter
+
+		// Old style locks have no owner process, and were only ever timed by
+		// their modification times, as the old BeginService did
+
+		if rec.Holder.PID == 0 {
+			s.Stale = s.Expired
+		} else {
+			s.OwnerAlive = ProcessAlive(rec.Holder.PID)
+			s.Stale = LockIsStale(rec.Holder,policy.ExpireAfter,now)
+		}
+	}
+
+	return s
+}
+
+// ****************************************************************************
+
+func ListLocks(now int64) ([]LockStatus,error) {
+
+	locker, err := GetLocker()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ListLocksIn(locker,now)
+}
+
+// ****************************************************************************
+
+func ListLocksIn(locker LockLister, now int64) ([]LockStatus,error) {
+
+	var list []LockStatus
+
+	records, err := locker.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _,rec := range records {
+		list = append(list,AssessLock(rec,now))
+	}
+
+	return list, nil
+}
+
+// ****************************************************************************
+
+func CleanLocks(now int64, force bool, names []string) ([]LockCleanup,error) {
+
+	// Break stale running locks, and forget completion markers that no longer
+	// restrict anything. With force, the named locks (or all, if none are
+	// named) are expired whether stale or not
+
+	locker, err := GetLocker()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return CleanLocksIn(locker,now,force,names)
+}
+
+// ****************************************************************************
+
+func CleanLocksIn(locker LockLister, now int64, force bool, names []string) ([]LockCleanup,error) {
+
+	var done []LockCleanup
+
+	// Other programs leave lock.* and last.* files in /tmp too, so there we
+	// only touch what we are told to
+
+	if _, legacy := locker.(LegacyLockDir); legacy && len(names) == 0 {
+		return nil, fmt.Errorf("name the legacy locks to clean, other programs' files look the same")
+	}
+
+	list, err := ListLocksIn(locker,now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _,s := range list {
+
+		if (len(names) > 0 && !MatchesAny(s.Name,names)) || s.Foreign {
+			continue
+		}
+
+		expire := s.Running && (s.Stale || force)
+		forget := s.Last != "" && !s.TooSoon && !s.Running
+
+		if expire {
+			done = append(done,LockCleanup{ Name: s.Name, Action: LOCK_EXPIRED, Error: locker.Remove(s.LockRecord,true,false) })
+		}
+
+		if forget {
+			done = append(done,LockCleanup{ Name: s.Name, Action: LOCK_FORGOTTEN, Error: locker.Remove(s.LockRecord,false,true) })
+		}
+	}
+
+	return done, nil
+}
+
+// ****************************************************************************
+
+func MatchesAny(name string, names []string) bool {
+
+	for _,n := range names {
+		if n == name || n == LockFileName(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ****************************************************************************
+
+func (l *FileLocker) List() ([]LockRecord,error) {
+
+	entries, err := os.ReadDir(l.Dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]*LockRecord)
+
+	for _,entry := range entries {
+
+		filename := entry.Name()
+
+		if strings.HasSuffix(filename,".tmp") {
+			continue
+		}
+
+		var kind, suffix string
+
+		if strings.HasPrefix(filename,"lock.") {
+			kind, suffix = "lock", strings.TrimPrefix(filename,"lock.")
+		} else if strings.HasPrefix(filename,"last.") {
+			kind, suffix = "last", strings.TrimPrefix(filename,"last.")
+		} else {
+			continue
+		}
+
+		path := filepath.Join(l.Dir,filename)
+		owner, err := ReadLockOwner(path)
+
+		if err != nil {
+			continue  // gone while we looked
+		}
+
+		rec, ok := records[suffix]
+
+		if !ok {
+			rec = &LockRecord{ Name: suffix }
+			records[suffix] = rec
+		}
+
+		if owner.Name != "" {
+			rec.Name = owner.Name
+		}
+
+		if kind == "lock" {
+			rec.This = path
+			rec.Holder = owner
+		} else {
+			rec.Last = path
+			rec.Completed = owner.Start
+		}
+	}
+
+	return SortedLockRecords(records), nil
+}
+
+// ****************************************************************************
+
+func (l *FileLocker) Remove(rec LockRecord, running,last bool) error {
+
+	unlock, err := l.guard()
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// Make sure nobody has taken or completed it since we looked
+
+	if running && rec.This != "" {
+
+		holder, err := ReadLockOwner(rec.This)
+
+		if err == nil && holder == rec.Holder {
+			if err = os.Remove(rec.This); err != nil {
+				return err
+			}
+		}
+	}
+
+	if last && rec.Last != "" {
+
+		done, err := ReadLockOwner(rec.Last)
+
+		if err == nil && done.Start == rec.Completed {
+			if err = os.Remove(rec.Last); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ****************************************************************************
+
+func (l *InProcessLocker) List() ([]LockRecord,error) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	records := make(map[string]*LockRecord)
+
+	for name,holder := range l.held {
+		records[name] = &LockRecord{ Name: name, This: "lock." + name, Holder: holder }
+	}
+
+	for name,t := range l.last {
+
+		rec, ok := records[name]
+
+		if !ok {
+			rec = &LockRecord{ Name: name }
+			records[name] = rec
+		}
+
+		rec.Last = "last." + name
+		rec.Completed = t
+	}
+
+	return SortedLockRecords(records), nil
+}
+
+// ****************************************************************************
+
+func (l *InProcessLocker) Remove(rec LockRecord, running,last bool) error {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if running && l.held[rec.Name] == rec.Holder {
+		delete(l.held,rec.Name)
+	}
+
+	if last && l.last[rec.Name] == rec.Completed {
+		delete(l.last,rec.Name)
+	}
+
+	return nil
+}
+
+// ****************************************************************************
+
+func (l LegacyLockDir) List() ([]LockRecord,error) {
+
+	// Read only: nothing is opened, old style locks are only timed by
+	// their modification times, and have no owner process
+
+	entries, err := os.ReadDir(l.Dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]*LockRecord)
+
+	for _,entry := range entries {
+
+		filename := entry.Name()
+
+		var kind, name string
+
+		if strings.HasPrefix(filename,"lock.") {
+			kind, name = "lock", strings.TrimPrefix(filename,"lock.")
+		} else if strings.HasPrefix(filename,"last.") {
+			kind, name = "last", strings.TrimPrefix(filename,"last.")
+		} else {
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(l.Dir,filename))
+
+		if err != nil || !info.Mode().IsRegular() {
+			continue  // gone while we looked, or not a lock file
+		}
+
+		rec, ok := records[name]
+
+		if !ok {
+			rec = &LockRecord{ Name: name }
+			records[name] = rec
+		}
+
+		if !OwnedBySelf(info) {
+			rec.Foreign = true
+		}
+
+		path := filepath.Join(l.Dir,filename)
+
+		if kind == "lock" {
+			rec.This = path
+			rec.Holder = LockOwner{ Name: name, Start: info.ModTime().UnixNano() }
+		} else {
+			rec.Last = path
+			rec.Completed = info.ModTime().UnixNano()
+		}
+	}
+
+	return SortedLockRecords(records), nil
+}
+
+// ****************************************************************************
+
+func (l LegacyLockDir) Remove(rec LockRecord, running,last bool) error {
+
+	// Only our own regular files, and only if nobody has touched them since
+	// we looked
+
+	remove := func(path string, when int64) error {
+
+		info, err := os.Lstat(path)
+
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().UnixNano() != when {
+			return nil
+		}
+
+		if !OwnedBySelf(info) {
+			return fmt.Errorf("%s belongs to another user",path)
+		}
+
+		return os.Remove(path)
+	}
+
+	if running && rec.This != "" {
+		if err := remove(rec.This,rec.Holder.Start); err != nil {
+			return err
+		}
+	}
+
+	if last && rec.Last != "" {
+		if err := remove(rec.Last,rec.Completed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ****************************************************************************
+
+func OwnedBySelf(info os.FileInfo) bool {
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+
+	return ok && int(st.Uid) == os.Getuid()
+}
+
+// ****************************************************************************
+
+func SortedLockRecords(records map[string]*LockRecord) []LockRecord {
+
+	var list []LockRecord
+
+	for _,rec := range records {
+		list = append(list,*rec)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
@@ -0,0 +1,474 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Lock backends for BeginService/EndService
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+)
+
+// ****************************************************************************
+// A Locker decides whether a service may run now (ifelapsed since it last
+// completed, and nobody else running it), and records who holds it. A lock
+// is stale, and may be broken, when its owner process is gone or it has run
+// longer than expireafter. Being busy or too soon is not an error - it's
+// Lock.Ready == false. Errors mean the backend itself can't be trusted.
+// ****************************************************************************
+
+type Locker interface {
+
+	Acquire(name string, ifelapsed,expireafter int64, now int64) (Lock,error)
+	Release(lock Lock, now int64) error
+
+	// For inspection and cleanup, see lockadmin.go
+
+	List() ([]LockRecord,error)
+	Remove(rec LockRecord, running,last bool) error
+}
+
+// ****************************************************************************
+
+type LockOwner struct {
+
+	Name  string `json:"name"`
+	PID   int    `json:"pid"`
+	Host  string `json:"host"`
+	Start int64  `json:"start"`  // ns, when acquired (or, for last, completed)
+}
+
+// ****************************************************************************
+
+var LOCKER Locker
+
+// ****************************************************************************
+
+func SetLocker(l Locker) Locker {
+
+	// Returns the previous locker, so that it can be restored
+
+	previous := LOCKER
+	LOCKER = l
+	return previous
+}
+
+// ****************************************************************************
+
+func GetLocker() (Locker,error) {
+
+	// The default is a private lock directory, created on first use, so
+	// programs can still change LOCKDIR before they begin
+
+	if LOCKER != nil {
+		return LOCKER, nil
+	}
+
+	l, err := NewFileLocker(LOCKDIR)
+
+	if err != nil {
+		return nil, err
+	}
+
+	LOCKER = l
+	return LOCKER, nil
+}
+
+// ****************************************************************************
+
+func DefaultLockDir() string {
+
+	return filepath.Join(os.TempDir(),fmt.Sprintf("TT-locks-%d",os.Getuid()))
+}
+
+// ****************************************************************************
+
+func LockOwnerSelf(name string, now int64) LockOwner {
+
+	host,_ := os.Hostname()
+
+	return LockOwner{ Name: name, PID: os.Getpid(), Host: host, Start: now }
+}
+
+// ****************************************************************************
+
+func LockIsStale(owner LockOwner, expireafter int64, now int64) bool {
+
+	// server threads can't be forced to quit,
+	// so we can only ask nicely to release resources
+	// as part of a standard promise
+	// If the thread can change something downstream, it needs to be stopped
+	// For a read only server process, it's safe to continue
+
+	runtime := (now - owner.Start) / NANO
+
+	if runtime > expireafter {
+		return true
+	}
+
+	host,_ := os.Hostname()
+
+	if owner.Host != "" && owner.Host != host {
+		return false // can't see other hosts' processes
+	}
+
+	return !ProcessAlive(owner.PID)
+}
+
+// ****************************************************************************
+
+func ProcessAlive(pid int) bool {
+
+	if pid <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(pid,0)
+
+	// EPERM means it exists, but belongs to someone else
+
+	return err == nil || errors.Is(err,syscall.EPERM)
+}
+
+// ****************************************************************************
+
+var LOCKNAME_UNSAFE = regexp.MustCompile("[^a-zA-Z0-9._-]")
+
+func LockFileName(name string) string {
+
+	// Names become file names, so nothing may escape the directory. Different
+	// names must not collide, so anything altered carries a hash of the original
+
+	safe := LOCKNAME_UNSAFE.ReplaceAllString(name,"_")
+
+	if safe != name || safe == "" || safe[0] == '.' {
+		safe = safe + "." + fnvhash([]byte(name))
+	}
+
+	return safe
+}
+
+// ****************************************************************************
+// Private directory, O_EXCL lock files holding their owner, flock for
+// atomic check-and-break across processes
+// ****************************************************************************
+
+type FileLocker struct {
+
+	Dir string
+}
+
+// ****************************************************************************
+
+func NewFileLocker(dir string) (*FileLocker,error) {
+
+	err := os.MkdirAll(dir,0700)
+
+	if err != nil {
+		return nil, fmt.Errorf("lock directory %s: %v",dir,err)
+	}
+
+	info, err := os.Lstat(dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("lock directory %s: %v",dir,err)
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("lock directory %s is not a directory",dir)
+	}
+
+	// Anyone else who can write here could forge or delete our locks
+
+	if info.Mode().Perm() & 0077 != 0 {
+		return nil, fmt.Errorf("lock directory %s is accessible to others (%v)",dir,info.Mode().Perm())
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return nil, fmt.Errorf("lock directory %s is owned by uid %d, not us",dir,st.Uid)
+	}
+
+	return &FileLocker{ Dir: dir }, nil
+}
+
+// ****************************************************************************
+
+func (l *FileLocker) Acquire(name string, ifelapsed,expireafter int64, now int64) (Lock,error) {
+
+	var lock Lock
+
+	lock.Name = name
+	lock.Last = filepath.Join(l.Dir,"last." + LockFileName(name))
+	lock.This = filepath.Join(l.Dir,"lock." + LockFileName(name))
+
+	unlock, err := l.guard()
+
+	if err != nil {
+		return lock, err
+	}
+
+	defer unlock()
+
+	last, err := ReadLockOwner(lock.Last)
+
+	if err != nil && !os.IsNotExist(err) {
+		return lock, err
+	}
+
+	elapsedtime := (now - last.Start) / NANO // in seconds
+
+	Println("Check elapsed time...",elapsedtime,ifelapsed)
+
+	if elapsedtime < ifelapsed {
+		Println("Too soon since last",lock.Last,elapsedtime,"/",ifelapsed)
+		return lock, nil
+	}
+
+	Println("Looking for current lock...")
+
+	holder, err := ReadLockOwner(lock.This)
+
+	if err == nil {
+
+		if !LockIsStale(holder,expireafter,now) {
+			Println("Lock held by pid",holder.PID)
+			return lock, nil
+		}
+
+		Println("Breaking stale lock held by pid",holder.PID)
+
+		if err = os.Remove(lock.This); err != nil {
+			return lock, err
+		}
+
+	} else if !os.IsNotExist(err) {
+		return lock, err
+	}
+
+	lock.Owner = LockOwnerSelf(name,now)
+
+	if err = WriteLockOwner(lock.This,lock.Owner,true); err != nil {
+		return lock, err
+	}
+
+	lock.Ready = true
+	return lock, nil
+}
+
+// ****************************************************************************
+
+func (l *FileLocker) Release(lock Lock, now int64) error {
+
+	if !lock.Ready {
+		return nil  // we never held it
+	}
+
+	unlock, err := l.guard()
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// Only remove the lock if it's still ours - it may have been broken as stale
+
+	holder, err := ReadLockOwner(lock.This)
+
+	if err == nil && holder == lock.Owner {
+
+		if err = os.Remove(lock.This); err != nil {
+			return err
+		}
+	}
+
+	done := LockOwnerSelf(lock.Name,now)
+
+	return WriteLockOwner(lock.Last,done,false)
+}
+
+// ****************************************************************************
+
+func (l *FileLocker) guard() (func(),error) {
+
+	// One flock per directory serializes check-then-act between processes
+	// (and between goroutines, as each opens its own descriptor)
+
+	f, err := os.OpenFile(filepath.Join(l.Dir,".guard"),os.O_CREATE|os.O_RDWR,0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(f.Fd()),syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()),syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// ****************************************************************************
+
+func ReadLockOwner(filename string) (LockOwner,error) {
+
+	var owner LockOwner
+
+	content, err := os.ReadFile(filename)
+
+	if err != nil {
+		return owner, err
+	}
+
+	if len(content) > 0 {
+
+		if err = json.Unmarshal(content,&owner); err == nil {
+			return owner, nil
+		}
+
+		fmt.Println("Corrupt lock file",filename,err)
+	}
+
+	// An old style empty lock file, or one cut short by a crash, is timed only
+	// by its modification time, and has no owner to keep it alive
+
+	info, err := os.Stat(filename)
+
+	if err != nil {
+		return owner, err
+	}
+
+	owner = LockOwner{ Start: info.ModTime().UnixNano() }
+	return owner, nil
+}
+
+// ****************************************************************************
+
+func WriteLockOwner(filename string, owner LockOwner, exclusive bool) error {
+
+	content, _ := json.Marshal(owner)
+
+	if exclusive {
+
+		f, err := os.OpenFile(filename,os.O_CREATE|os.O_EXCL|os.O_WRONLY,0600)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(content)
+
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		return err
+	}
+
+	// Replace atomically, so a reader never sees half a record
+
+	tmp := filename + ".tmp"
+
+	if err := os.WriteFile(tmp,content,0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp,filename)
+}
+
+// ****************************************************************************
+// Locks in memory, for a single process (threads of a server, tests, replay)
+// ****************************************************************************
+
+type InProcessLocker struct {
+
+	mutex sync.Mutex
+	held  map[string]LockOwner
+	last  map[string]int64
+}
+
+// ****************************************************************************
+
+func NewInProcessLocker() *InProcessLocker {
+
+	return &InProcessLocker{ held: make(map[string]LockOwner), last: make(map[string]int64) }
+}
+
+// ****************************************************************************
+
+func (l *InProcessLocker) Acquire(name string, ifelapsed,expireafter int64, now int64) (Lock,error) {
+
+	var lock Lock
+
+	lock.Name = name
+	lock.Last = "last." + name
+	lock.This = "lock." + name
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	elapsedtime := (now - l.last[name]) / NANO
+
+	if elapsedtime < ifelapsed {
+		Println("Too soon since last",name,elapsedtime,"/",ifelapsed)
+		return lock, nil
+	}
+
+	// Our own process is always alive, so only expiry makes a lock stale
+
+	if holder, held := l.held[name]; held && (now - holder.Start) / NANO <= expireafter {
+		return lock, nil
+	}
+
+	lock.Owner = LockOwnerSelf(name,now)
+	l.held[name] = lock.Owner
+	lock.Ready = true
+
+	return lock, nil
+}
+
+// ****************************************************************************
+
+func (l *InProcessLocker) Release(lock Lock, now int64) error {
+
+	if !lock.Ready {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.held[lock.Name] == lock.Owner {
+		delete(l.held,lock.Name)
+	}
+
+	l.last[lock.Name] = now
+	return nil
+}
@@ -0,0 +1,421 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Declarative promise policy - SLO bounds, trust intervals, anti-DoS limits
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ****************************************************************************
+// Promises are declared by exact name or by glob pattern, e.g.
+//
+// {
+//   "defaults": { "upper_bound": 1.6, "trust_interval": 1.0, "ifelapsed": 30, "expireafter": 60 },
+//   "promises": [
+//      { "name": "tcp_service", "upper_bound": 1.6 },
+//      { "pattern": "tcp_serviceprovider*", "upper_bound": 2.0, "ifelapsed": 10 },
+//      { "name": "checkout", "quantile": "p99 < 1.6s", "objective": 0.99 },
+//      { "name": "search", "admission": { "kind": "token_bucket", "rate": 0.5, "burst": 5 } }
+//   ]
+// }
+//
+// Fields left out inherit the defaults. A field given in the file overrides
+// them even when it is zero, e.g. "ifelapsed": 0 for no rate limit (as does
+// -1), or "objective": 0 for no error budget. An admission policy replaces
+// the ifelapsed rule with a quota (see admission.go).
+// ****************************************************************************
+
+type PromisePolicy struct {
+
+	Name          string       `json:"name"`
+	Pattern       string       `json:"pattern"`
+
+	UpperBound    float64      `json:"upper_bound"`    // promised response time (s)
+	TrustInterval float64      `json:"trust_interval"` // desired monitoring interval (s)
+	Quantile      string       `json:"quantile"`       // optional tail promise, e.g. "p99 < 1.6s"
+
+	IfElapsed     int64        `json:"ifelapsed"`      // min seconds between service requests
+	ExpireAfter   int64        `json:"expireafter"`    // seconds before a running lock expires
+
+	Objective     float64      `json:"objective"`      // SLO fraction of outcomes kept, 0 = no error budget
+	SLOPeriod     int64        `json:"slo_period"`     // error budget period (s)
+	ExhaustionWarning float64  `json:"exhaustion_warning"` // warn if budget runs out sooner than this (s)
+
+	LearningRate  float64      `json:"learning_rate"`  // weight of a new assessment in reliability
+	HistoryRate   float64      `json:"history_rate"`   // weight of a new sample in PromiseHistory averages
+
+	Decay         *DecayPolicy `json:"decay"`          // nil means TRUST_DECAY
+
+	Admission     *AdmissionPolicy `json:"admission"`  // nil means the ifelapsed lock rule
+
+	set           map[string]bool  // fields present in the JSON, so that zero can override
+}
+
+// ****************************************************************************
+
+type PolicySet struct {
+
+	Defaults PromisePolicy   `json:"defaults"`
+	Promises []PromisePolicy `json:"promises"`
+}
+
+// ****************************************************************************
+
+// These were the hard-coded values before policy existed
+
+var DEFAULT_PROMISE_POLICY = PromisePolicy{
+
+	UpperBound:    1.6,
+	TrustInterval: 1.0,
+	IfElapsed:     30,
+	ExpireAfter:   60,
+	SLOPeriod:     30*24*3600,
+	ExhaustionWarning: 24*3600,
+	LearningRate:  0.6,
+	HistoryRate:   0.5,
+}
+
+var POLICY = PolicySet{ Defaults: DEFAULT_PROMISE_POLICY }
+
+// ****************************************************************************
+
+func LoadPromisePolicy(filename string) (PolicySet,error) {
+
+	// Read a JSON policy file, fill in missing defaults and make it current
+
+	var policy PolicySet
+
+	content, err := os.ReadFile(filename)
+
+	if err != nil {
+		return POLICY, err
+	}
+
+	err = json.Unmarshal(content,&policy)
+
+	if err != nil {
+		return POLICY, fmt.Errorf("promise policy %s: %v",filename,err)
+	}
+
+	policy.Defaults = MergePromisePolicy(DEFAULT_PROMISE_POLICY,policy.Defaults)
+
+	if policy.Defaults.Admission != nil {
+		if err := ValidAdmissionPolicy(*policy.Defaults.Admission); err != nil {
+			return POLICY, fmt.Errorf("promise policy %s: defaults: %v",filename,err)
+		}
+	}
+
+	if err := ValidPromisePolicy(policy.Defaults); err != nil {
+		return POLICY, fmt.Errorf("promise policy %s: defaults: %v",filename,err)
+	}
+
+	for p := range policy.Promises {
+
+		if policy.Promises[p].Name == "" && policy.Promises[p].Pattern == "" {
+			return POLICY, fmt.Errorf("promise policy %s: entry %d has neither name nor pattern",filename,p)
+		}
+
+		if err := ValidPromisePolicy(MergePromisePolicy(policy.Defaults,policy.Promises[p])); err != nil {
+			return POLICY, fmt.Errorf("promise policy %s: entry %d: %v",filename,p,err)
+		}
+
+		if policy.Promises[p].Quantile != "" {
+			if _,err := ParseQuantilePromise(policy.Promises[p].Quantile); err != nil {
+				return POLICY, fmt.Errorf("promise policy %s: %v",filename,err)
+			}
+		}
+
+		if policy.Promises[p].Admission != nil {
+			if err := ValidAdmissionPolicy(*policy.Promises[p].Admission); err != nil {
+				return POLICY, fmt.Errorf("promise policy %s: entry %d: %v",filename,p,err)
+			}
+		}
+
+		if policy.Promises[p].Pattern != "" {
+			if _,err := path.Match(policy.Promises[p].Pattern,""); err != nil {
+				return POLICY, fmt.Errorf("promise policy %s: bad pattern \"%s\": %v",filename,policy.Promises[p].Pattern,err)
+			}
+		}
+	}
+
+	SetPromisePolicy(policy)
+
+	return policy, nil
+}
+
+// ****************************************************************************
+
+func ValidPromisePolicy(p PromisePolicy) error {
+
+	// Now that zero can be given explicitly, some fields can't be zero
+
+	if p.UpperBound <= 0 || p.TrustInterval <= 0 {
+		return fmt.Errorf("upper_bound and trust_interval should be > 0")
+	}
+
+	if p.Objective > 0 && p.SLOPeriod <= 0 {
+		return fmt.Errorf("an objective needs slo_period > 0")
+	}
+
+	if p.LearningRate < 0 || p.LearningRate > 1 || p.HistoryRate <= 0 || p.HistoryRate > 1 {
+		return fmt.Errorf("learning_rate should be in [0,1] and history_rate in (0,1]")
+	}
+
+	decay := PolicyDecay(p)
+
+	if decay.Prior < 0 || decay.Prior > 1 || decay.HalfLife <= 0 || decay.Bootstrap <= 0 {
+		return fmt.Errorf("decay prior should be in [0,1], half_life and bootstrap > 0")
+	}
+
+	return nil
+}
+
+// ****************************************************************************
+
+func SetPromisePolicy(policy PolicySet) {
+
+	POLICY = policy
+}
+
+// ****************************************************************************
+
+func (p *PromisePolicy) UnmarshalJSON(data []byte) error {
+
+	// Decode as usual, remembering which fields were given
+
+	type plain PromisePolicy
+
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(data,&fields); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data,(*plain)(p)); err != nil {
+		return err
+	}
+
+	p.set = make(map[string]bool)
+
+	for field := range fields {
+		p.set[strings.ToLower(field)] = true
+	}
+
+	return nil
+}
+
+// ****************************************************************************
+
+func (d *DecayPolicy) UnmarshalJSON(data []byte) error {
+
+	// As for PromisePolicy, so that a decay block need only give what changes
+
+	type plain DecayPolicy
+
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(data,&fields); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data,(*plain)(d)); err != nil {
+		return err
+	}
+
+	d.set = make(map[string]bool)
+
+	for field := range fields {
+		d.set[strings.ToLower(field)] = true
+	}
+
+	return nil
+}
+
+// ****************************************************************************
+
+func MergePromisePolicy(base, override PromisePolicy) PromisePolicy {
+
+	// A field overrides the base if it was given in JSON, or for policies
+	// made in code, if it is not zero
+
+	merged := base
+	merged.set = nil
+
+	merged.Name = override.Name
+	merged.Pattern = override.Pattern
+
+	if override.UpperBound != 0 || override.set["upper_bound"] {
+		merged.UpperBound = override.UpperBound
+	}
+
+	if override.TrustInterval != 0 || override.set["trust_interval"] {
+		merged.TrustInterval = override.TrustInterval
+	}
+
+	if override.Quantile != "" || override.set["quantile"] {
+		merged.Quantile = override.Quantile
+	}
+
+	if override.IfElapsed != 0 || override.set["ifelapsed"] {
+		merged.IfElapsed = override.IfElapsed
+	}
+
+	if override.ExpireAfter != 0 || override.set["expireafter"] {
+		merged.ExpireAfter = override.ExpireAfter
+	}
+
+	if override.Objective != 0 || override.set["objective"] {
+		merged.Objective = override.Objective
+	}
+
+	if override.SLOPeriod != 0 || override.set["slo_period"] {
+		merged.SLOPeriod = override.SLOPeriod
+	}
+
+	if override.ExhaustionWarning != 0 || override.set["exhaustion_warning"] {
+		merged.ExhaustionWarning = override.ExhaustionWarning
+	}
+
+	if override.LearningRate != 0 || override.set["learning_rate"] {
+		merged.LearningRate = override.LearningRate
+	}
+
+	if override.HistoryRate != 0 || override.set["history_rate"] {
+		merged.HistoryRate = override.HistoryRate
+	}
+
+	if override.Decay != nil {
+		decay := MergeDecayPolicy(PolicyDecay(base),*override.Decay)
+		merged.Decay = &decay
+	}
+
+	if override.Admission != nil {
+		merged.Admission = override.Admission
+	}
+
+	return merged
+}
+
+// ****************************************************************************
+
+func MergeDecayPolicy(base, override DecayPolicy) DecayPolicy {
+
+	// Field by field, as MergePromisePolicy
+
+	merged := base
+	merged.set = nil
+
+	if override.Prior != 0 || override.set["prior"] {
+		merged.Prior = override.Prior
+	}
+
+	if override.HalfLife != 0 || override.set["half_life"] {
+		merged.HalfLife = override.HalfLife
+	}
+
+	if override.StaleAfter != 0 || override.set["stale_after"] {
+		merged.StaleAfter = override.StaleAfter
+	}
+
+	if override.Bootstrap != 0 || override.set["bootstrap"] {
+		merged.Bootstrap = override.Bootstrap
+	}
+
+	return merged
+}
+
+// ****************************************************************************
+
+func GetPromisePolicy(name string) PromisePolicy {
+
+	// Exact names take precedence over patterns, patterns match in order.
+	// Names are compared in canonical key form, so the raw name given to
+	// PromiseContext_Begin and the ctx.Name/PromiseId forms all agree
+
+	canonical := PromiseNameOf(name)
+
+	for p := range POLICY.Promises {
+
+		if POLICY.Promises[p].Name != "" && KeyName(POLICY.Promises[p].Name,0) == canonical {
+			return MergePromisePolicy(POLICY.Defaults,POLICY.Promises[p])
+		}
+	}
+
+	for p := range POLICY.Promises {
+
+		pattern := POLICY.Promises[p].Pattern
+
+		if pattern == "" {
+			continue
+		}
+
+		raw,_ := path.Match(pattern,name)
+		canon,_ := path.Match(pattern,canonical)
+
+		if raw || canon {
+			return MergePromisePolicy(POLICY.Defaults,POLICY.Promises[p])
+		}
+	}
+
+	return POLICY.Defaults
+}
+
+// ****************************************************************************
+
+func PromiseNameOf(key string) string {
+
+	// A PromiseHistory key is ctx.Name + ":" + DoughNowt timeslot, and canonical
+	// names never contain ':', so the promise name is the part before the first one
+
+	name := strings.SplitN(key,":",2)[0]
+
+	return KeyName(name,0)
+}
+
+// ****************************************************************************
+
+func PolicyDecay(p PromisePolicy) DecayPolicy {
+
+	if p.Decay != nil {
+		return *p.Decay
+	}
+
+	return TRUST_DECAY
+}
+
+// ****************************************************************************
+
+func AssessPromiseByPolicy(g Analytics, e PromiseHistory, assessed_quality float64) float64 {
+
+	// As AssessPromiseOutcome, with the promised bound and monitoring interval
+	// taken from the policy for this promise rather than from the caller, and
+	// the interval shortened by any sampling_rate rule (see MonitoringInterval)
+
+	p := GetPromisePolicy(e.PromiseId)
+
+	return AssessPromiseOutcome(g,e,assessed_quality,p.UpperBound,MonitoringInterval(e.PromiseId))
+}
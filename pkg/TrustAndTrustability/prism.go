@@ -0,0 +1,154 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* PrismResult - what TextPrism found, as data rather than printout
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+)
+
+// ****************************************************************************
+// Everything the text prism selects or measures, so that downstream tools
+// can read JSON instead of scraping the verbose output
+// ****************************************************************************
+
+type PrismEvent struct {
+
+	Sentence int     `json:"sentence"`  // index of the sentence in the text
+	Leg      int     `json:"leg"`
+	Rank     float64 `json:"rank"`      // intentionality of the sentence
+	Text     string  `json:"text"`
+}
+
+// ****************************************************************************
+
+type PrismLeg struct {
+
+	Leg          int     `json:"leg"`
+	Candidates   int     `json:"candidates"`     // distinctly ranked sentences to choose from
+	AvRank       float64 `json:"av_rank"`        // average sentence rank over the leg
+	RelativeRank float64 `json:"relative_rank"`  // relative to the most important leg, in [0,1]
+	Velocity     int     `json:"velocity"`       // events the leg was allowed to select
+	Selected     int     `json:"selected"`       // events it did select
+}
+
+// ****************************************************************************
+
+type PrismNgram struct {
+
+	Ngram  string  `json:"ngram"`
+	Intent float64 `json:"intent"`
+}
+
+// ****************************************************************************
+
+type PrismResult struct {
+
+	Subject    string               `json:"subject"`
+	Config     FractionationConfig  `json:"config"`
+	Language   string               `json:"language"`  // the language pack used, if any
+	LegEstimate *LegEstimate        `json:"leg_estimate,omitempty"`  // with AutoLegWindow, how Config.LegWindow was chosen
+
+	Sentences  int                  `json:"sentences"`
+	Words      int                  `json:"words"`
+	Kept       int                  `json:"kept"`        // events selected
+	Efficiency float64              `json:"efficiency"`  // kept / sentences
+
+	Legs       []PrismLeg           `json:"legs"`
+	Events     []PrismEvent         `json:"events"`
+
+	Intentional map[int][]PrismNgram `json:"intentional"` // by n-gram length, most intentional first
+
+	Ngrams     [MAXCLUSTERS]map[string]float64 `json:"-"`  // the same, as LongitudinalPersistentConcepts returns
+}
+
+// ****************************************************************************
+
+func MakePrismResult(subject string, config FractionationConfig, sentences, words int, legs []PrismLeg, events []PrismEvent, ngrams [MAXCLUSTERS]map[string]float64) PrismResult {
+
+	var r PrismResult
+
+	r.Subject = subject
+	r.Config = config
+	r.Sentences = sentences
+	r.Words = words
+	r.Legs = legs
+	r.Events = events
+	r.Kept = len(events)
+	r.Ngrams = ngrams
+
+	if sentences > 0 {
+		r.Efficiency = float64(r.Kept) / float64(sentences)
+	}
+
+	r.Intentional = make(map[int][]PrismNgram)
+
+	for n := 1; n < MAXCLUSTERS; n++ {
+
+		if len(ngrams[n]) == 0 {
+			continue
+		}
+
+		var list []PrismNgram
+
+		for ngram,intent := range ngrams[n] {
+			list = append(list,PrismNgram{ Ngram: ngram, Intent: intent })
+		}
+
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Intent == list[j].Intent {
+				return list[i].Ngram < list[j].Ngram
+			}
+			return list[i].Intent > list[j].Intent
+		})
+
+		r.Intentional[n] = list
+	}
+
+	return r
+}
+
+// ****************************************************************************
+
+func AppendPrismLeg(legs []PrismLeg, events []PrismEvent, leg PrismLeg, selected []PrismEvent) ([]PrismLeg,[]PrismEvent) {
+
+	if leg.Candidates < 1 {
+		return legs,events
+	}
+
+	return append(legs,leg), append(events,selected...)
+}
+
+// ****************************************************************************
+
+func SavePrismResult(filename string, r PrismResult) error {
+
+	content, err := json.MarshalIndent(r,"","  ")
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename,append(content,'\n'),0644)
+}
@@ -0,0 +1,278 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Multi-dimensional promise outcomes
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// ****************************************************************************
+// A service promise is seldom only about latency. Each dimension of an
+// outcome (latency, correctness, availability, payload size, ...) is
+// learned separately, against its own promised bound, and the results are
+// combined into a composite reliability with an explanation per dimension
+// ****************************************************************************
+
+const OUTCOME_AT_MOST = 0  // e.g. latency, payload size: smaller is better
+const OUTCOME_AT_LEAST = 1 // e.g. availability, correctness: larger is better
+
+const OUTCOME_LATENCY = "latency"
+const OUTCOME_COLLECTION = "PromiseOutcomes"
+
+// ****************************************************************************
+
+type OutcomeDimension struct {
+
+	Name    string
+	Value   float64  // measured value in this episode
+	Bound   float64  // promised upper or lower bound, same units as Value
+	Sense   int      // OUTCOME_AT_MOST or OUTCOME_AT_LEAST
+	Weight  float64  // relative importance in the composite
+	Units   string
+
+	History PromiseHistory
+}
+
+// ****************************************************************************
+
+type PromiseOutcome struct {
+
+	PromiseId  string
+	Dimensions []OutcomeDimension
+}
+
+// ****************************************************************************
+
+type DimensionAssessment struct {
+
+	Name        string
+	Level       float64  // degree of promise keeping in [0,1]
+	Weight      float64
+	Explanation string
+}
+
+// ****************************************************************************
+
+type OutcomeAssessment struct {
+
+	PromiseId   string
+	Composite   float64  // weighted promise keeping level for this episode
+	Reliability float64  // running reliability after learning the composite
+	Dimensions  []DimensionAssessment
+}
+
+// ****************************************************************************
+
+func NewPromiseOutcome(name string) PromiseOutcome {
+
+	var o PromiseOutcome
+	o.PromiseId = KeyName(name,0)
+	return o
+}
+
+// ****************************************************************************
+
+func AddOutcomeDimension(o *PromiseOutcome, name string, value, bound, weight float64, sense int, units string) {
+
+	var d OutcomeDimension
+
+	d.Name = KeyName(name,0)
+	d.Value = value
+	d.Bound = bound
+	d.Weight = weight
+	d.Sense = sense
+	d.Units = units
+
+	o.Dimensions = append(o.Dimensions,d)
+}
+
+// ****************************************************************************
+
+func PromiseLevel(q, bound float64, sense int) float64 {
+
+	// A soft threshold: exactly at the bound the promise is half kept,
+	// well inside it approaches 1, well outside it approaches 0
+
+	if bound == 0 {
+		return 0
+	}
+
+	if sense == OUTCOME_AT_LEAST {
+		return 1/(1+math.Exp(3*(bound-q)/bound))
+	}
+
+	return 1/(1+math.Exp(3*(q-bound)/bound))
+}
+
+// ****************************************************************************
+
+func PromiseOutcome_End(g Analytics, ctx PromiseContext, o PromiseOutcome) OutcomeAssessment {
+
+	after := CLOCK.Now()
+	return StampedPromiseOutcome_End(g,ctx,after,o)
+}
+
+// ****************************************************************************
+
+func StampedPromiseOutcome_End(g Analytics, ctx PromiseContext, after time.Time, o PromiseOutcome) OutcomeAssessment {
+
+	// Close the promise context as usual (latency is always measured there),
+	// then learn and assess every declared dimension of the outcome. A
+	// dimension named "latency" is filled in from the measured interval (s)
+
+	StampedPromiseContext_End(g,ctx,after)
+
+	if o.PromiseId == "" {
+		o.PromiseId = ctx.Name
+	}
+
+	for d := range o.Dimensions {
+		if o.Dimensions[d].Name == OUTCOME_LATENCY {
+			o.Dimensions[d].Value = after.Sub(ctx.Time).Seconds()
+			o.Dimensions[d].Units = "s"
+		}
+	}
+
+	o = LearnPromiseOutcome(g,o,after.UnixNano())
+
+	return AssessPromiseDimensions(g,o)
+}
+
+// ****************************************************************************
+
+func LearnPromiseOutcome(g Analytics, o PromiseOutcome, now int64) PromiseOutcome {
+
+	// Each dimension keeps its own running history, keyed by promise and dimension
+
+	policy := GetPromisePolicy(o.PromiseId)
+
+	for d := range o.Dimensions {
+
+		key := o.PromiseId + "_" + o.Dimensions[d].Name
+		o.Dimensions[d].History = LearnUpdateKeyValueRate(g,OUTCOME_COLLECTION,key,now,o.Dimensions[d].Value,o.Dimensions[d].Units,policy.HistoryRate)
+
+		RaiseAnomalyContexts(o.Dimensions[d].Name,o.Dimensions[d].History.Anomalies)
+	}
+
+	return o
+}
+
+// ****************************************************************************
+
+func AssessDimension(d OutcomeDimension) DimensionAssessment {
+
+	var a DimensionAssessment
+
+	e := d.History
+
+	a.Name = d.Name
+	a.Weight = d.Weight
+	a.Level = PromiseLevel(d.Value,d.Bound,d.Sense)
+
+	relation := "at most"
+
+	if d.Sense == OUTCOME_AT_LEAST {
+		relation = "at least"
+	}
+
+	a.Explanation = fmt.Sprintf("%s: measured %.4g %s, promised %s %.4g, kept to level %.2f",d.Name,d.Value,d.Units,relation,d.Bound,a.Level)
+
+	// Down vote for noisy behaviour, as for latency
+
+	sig := math.Sqrt(e.Q_var)
+
+	if e.Q_av != 0 && math.Abs(e.Q_av) < sig {
+		a.Level = a.Level / 1.5
+		a.Explanation += fmt.Sprintf(", penalized for noise (sigma %.4g > mean %.4g)",sig,e.Q_av)
+	}
+
+	return a
+}
+
+// ****************************************************************************
+
+func AssessPromiseDimensions(g Analytics, o PromiseOutcome) OutcomeAssessment {
+
+	// Combine the dimensions by weight into a single episode level, then learn
+	// this into the running reliability for the promise, as AssessPromiseOutcome does
+
+	var result OutcomeAssessment
+	var sum_weight float64
+
+	result.PromiseId = o.PromiseId
+
+	for d := range o.Dimensions {
+
+		a := AssessDimension(o.Dimensions[d])
+
+		result.Composite += a.Weight * a.Level
+		sum_weight += a.Weight
+		result.Dimensions = append(result.Dimensions,a)
+
+		Println("   Dimension",a.Explanation)
+	}
+
+	if sum_weight > 0 {
+		result.Composite = result.Composite / sum_weight
+	}
+
+	policy := GetPromisePolicy(o.PromiseId)
+	decay := PolicyDecay(policy)
+
+	reliability := GetKV(g,"PromiseKeeping",o.PromiseId)
+
+	if reliability.V == 0 {
+
+		reliability.V = decay.Prior
+
+	} else if len(o.Dimensions) > 0 {
+
+		// The dimensions are observed together, so any one carries the sampling interval
+
+		e := o.Dimensions[0].History
+
+		reliability.V = RelaxReliability(reliability.V,UnobservedInterval(e,decay),e,decay)
+	}
+
+	reliability.K = o.PromiseId
+	reliability.V = reliability.V * (1 - policy.LearningRate) + result.Composite * policy.LearningRate
+	reliability.V = ApplyTrustOffset(o.PromiseId,reliability.V)
+
+	AddKV(g,"PromiseKeeping",reliability)
+
+	result.Reliability = reliability.V
+
+	if policy.Objective > 0 && len(o.Dimensions) > 0 {
+
+		now := o.Dimensions[0].History.T
+
+		RecordPromiseKept(g,o.PromiseId,now,result.Composite >= BUDGET_KEPT_LEVEL)
+		AssessErrorBudget(g,o.PromiseId,now)
+	}
+
+	Println("   Composite promise level",result.Composite,"running reliability",result.Reliability)
+
+	return result
+}
@@ -0,0 +1,382 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Streaming quantile sketches for promise histories (tail latency)
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	A "github.com/arangodb/go-driver"
+)
+
+// ****************************************************************************
+// Mean and variance can't express tail behaviour, but promises about latency
+// are usually about p95 or p99. Values are counted in logarithmic buckets
+// (HDR/DDSketch style) with a fixed relative error, so sketches from
+// different agents or time windows can be merged simply by adding counts
+// ****************************************************************************
+
+const SKETCH_GAMMA = 1.02                   // bucket growth, about 1% relative error
+const SKETCH_WINDOW = CF_MEASURE_INTERVAL   // seconds per time window sketch
+const SKETCH_COLLECTION = "PromiseSketches"
+const SKETCH_RECENT = 12 * SKETCH_WINDOW      // seconds of windows a quantile promise is assessed over
+
+// ****************************************************************************
+
+type QuantileSketch struct {
+
+	Gamma  float64        `json:"gamma"`
+	Counts map[int]int64  `json:"counts"`  // bucket index -> occurrences
+	Zero   int64          `json:"zero"`    // values <= 0
+	Total  int64          `json:"total"`
+}
+
+// ****************************************************************************
+
+type WindowSketch struct {
+
+	Key     string         `json:"_key"`
+	Promise string         `json:"promise"`
+	Start   int64          `json:"start"`  // window start, Unix seconds
+	Sketch  QuantileSketch `json:"sketch"`
+}
+
+// ****************************************************************************
+
+type QuantileBound struct {
+
+	Quantile float64  // e.g. 0.99
+	Bound    float64  // upper bound in the units of the sketch (ns for time)
+	Spec     string   // the original text, e.g. "p99 < 1.6s"
+}
+
+// ****************************************************************************
+
+func NewQuantileSketch() QuantileSketch {
+
+	var s QuantileSketch
+	s.Gamma = SKETCH_GAMMA
+	s.Counts = make(map[int]int64)
+	return s
+}
+
+// ****************************************************************************
+
+func SketchAdd(s *QuantileSketch, v float64) {
+
+	if s.Gamma == 0 {
+		*s = NewQuantileSketch()
+	}
+
+	if s.Counts == nil {
+		s.Counts = make(map[int]int64)
+	}
+
+	s.Total++
+
+	if v <= 0 {
+		s.Zero++
+		return
+	}
+
+	i := int(math.Ceil(math.Log(v) / math.Log(s.Gamma)))
+	s.Counts[i]++
+}
+
+// ****************************************************************************
+
+func SketchMerge(s *QuantileSketch, other QuantileSketch) {
+
+	// Sketches are only mergeable with the same bucket geometry
+
+	if other.Total == 0 {
+		return
+	}
+
+	if s.Gamma == 0 {
+		*s = NewQuantileSketch()
+		s.Gamma = other.Gamma
+	}
+
+	if s.Gamma != other.Gamma {
+		fmt.Println("Can't merge quantile sketches with different gamma",s.Gamma,other.Gamma)
+		return
+	}
+
+	if s.Counts == nil {
+		s.Counts = make(map[int]int64)
+	}
+
+	for i := range other.Counts {
+		s.Counts[i] += other.Counts[i]
+	}
+
+	s.Zero += other.Zero
+	s.Total += other.Total
+}
+
+// ****************************************************************************
+
+func SketchQuantile(s QuantileSketch, q float64) float64 {
+
+	// Return the estimated value below which a fraction q of samples lie
+
+	if s.Total == 0 {
+		return 0
+	}
+
+	rank := int64(q * float64(s.Total-1))
+
+	if rank < s.Zero {
+		return 0
+	}
+
+	var index []int
+
+	for i := range s.Counts {
+		index = append(index,i)
+	}
+
+	sort.Ints(index)
+
+	cumulative := s.Zero
+
+	for _,i := range index {
+
+		cumulative += s.Counts[i]
+
+		if cumulative > rank {
+
+			// Representative value of bucket (gamma^(i-1), gamma^i]
+
+			return 2 * math.Pow(s.Gamma,float64(i)) / (s.Gamma + 1)
+		}
+	}
+
+	return 2 * math.Pow(s.Gamma,float64(index[len(index)-1])) / (s.Gamma + 1)
+}
+
+// ****************************************************************************
+
+func ParseQuantilePromise(spec string) (QuantileBound,error) {
+
+	// Parse a promise like "p99 < 1.6s", "p95<200ms" or "p50 < 12"
+	// Time units are converted to ns, to match latency histories
+
+	var qb QuantileBound
+
+	qb.Spec = spec
+
+	r := regexp.MustCompile(`^\s*[pP]([0-9]+(\.[0-9]+)?)\s*<=?\s*([0-9.eE+-]+)\s*(ns|us|µs|ms|s|min)?\s*$`)
+	m := r.FindStringSubmatch(spec)
+
+	if m == nil {
+		return qb, fmt.Errorf("bad quantile promise \"%s\", expected e.g. \"p99 < 1.6s\"",spec)
+	}
+
+	percentile,_ := strconv.ParseFloat(m[1],64)
+
+	if percentile <= 0 || percentile >= 100 {
+		return qb, fmt.Errorf("quantile promise \"%s\" must have 0 < p < 100",spec)
+	}
+
+	bound,err := strconv.ParseFloat(m[3],64)
+
+	if err != nil {
+		return qb, fmt.Errorf("quantile promise \"%s\": %v",spec,err)
+	}
+
+	switch strings.TrimSpace(m[4]) {
+	case "ns":
+	case "us","µs":
+		bound *= 1000
+	case "ms":
+		bound *= MILLI
+	case "s":
+		bound *= NANO
+	case "min":
+		bound *= 60 * NANO
+	}
+
+	qb.Quantile = percentile / 100
+	qb.Bound = bound
+
+	return qb, nil
+}
+
+// ****************************************************************************
+
+func QuantilePromiseLevel(s QuantileSketch, qb QuantileBound) float64 {
+
+	// Degree to which the quantile promise is kept, on the same soft
+	// threshold as AssessPromiseOutcome uses for a single sample
+
+	if s.Total == 0 {
+		return 0
+	}
+
+	return PromiseLevel(SketchQuantile(s,qb.Quantile),qb.Bound,OUTCOME_AT_MOST)
+}
+
+// ****************************************************************************
+// Time windows
+// ****************************************************************************
+
+func WindowStart(now int64) int64 {
+
+	// now should be time.Now().UnixNano(), result in Unix seconds
+
+	secs := now / NANO
+	return secs - secs % SKETCH_WINDOW
+}
+
+// ****************************************************************************
+
+func AddToSketchWindow(g Analytics, promise string, now int64, value float64) {
+
+	// Record one sample in the sketch for the window containing now
+
+	coll, err := g.S_db.Collection(nil, SKETCH_COLLECTION)
+
+	if err != nil {
+		coll, err = g.S_db.CreateCollection(nil, SKETCH_COLLECTION, nil)
+
+		if err != nil {
+			fmt.Println("AddToSketchWindow: no such collection",SKETCH_COLLECTION,err)
+			return
+		}
+	}
+
+	var w WindowSketch
+
+	w.Promise = promise
+	w.Start = WindowStart(now)
+	w.Key = fmt.Sprintf("%s@%d",promise,w.Start)
+
+	exists,_ := coll.DocumentExists(nil,w.Key)
+
+	if exists {
+		_,err = coll.ReadDocument(nil,w.Key,&w)
+
+		if err != nil {
+			fmt.Println("AddToSketchWindow: failed to read",w.Key,err)
+			return
+		}
+	}
+
+	SketchAdd(&w.Sketch,value)
+
+	if exists {
+		_,err = coll.ReplaceDocument(nil,w.Key,w)
+	} else {
+		_,err = coll.CreateDocument(nil,w)
+	}
+
+	if err != nil {
+		fmt.Println("AddToSketchWindow: failed to write",w.Key,err)
+	}
+}
+
+// ****************************************************************************
+
+func GetWindowSketch(g Analytics, promise string, from, to int64) QuantileSketch {
+
+	// Merge the window sketches for promise between from and to (Unix seconds)
+
+	merged := NewQuantileSketch()
+
+	exists,_ := g.S_db.CollectionExists(nil,SKETCH_COLLECTION)
+
+	if !exists {
+		return merged
+	}
+
+	querystring := "FOR doc IN " + SKETCH_COLLECTION + " FILTER doc.promise == @promise && doc.start >= @from && doc.start <= @to RETURN doc"
+
+	bind := map[string]interface{}{ "promise": promise, "from": WindowStart(from*NANO), "to": to }
+
+	cursor,err := g.S_db.Query(nil,querystring,bind)
+
+	if err != nil {
+		fmt.Printf("Query \""+ querystring +"\" failed: %v", err)
+		return merged
+	}
+
+	defer cursor.Close()
+
+	for {
+		var w WindowSketch
+
+		_,err = cursor.ReadDocument(nil,&w)
+
+		if A.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			fmt.Printf("Sketch returned: %v", err)
+		} else {
+			SketchMerge(&merged,w.Sketch)
+		}
+	}
+
+	return merged
+}
+
+// ****************************************************************************
+
+func RecentSketch(windows map[int64]QuantileSketch, now int64) QuantileSketch {
+
+	// As GetWindowSketch for the last SKETCH_RECENT seconds before now (ns),
+	// for windows kept in memory by start time, forgetting older ones
+
+	merged := NewQuantileSketch()
+	from := WindowStart(now - SKETCH_RECENT * NANO)
+
+	for start := range windows {
+
+		if start < from {
+			delete(windows,start)
+			continue
+		}
+
+		SketchMerge(&merged,windows[start])
+	}
+
+	return merged
+}
+
+// ****************************************************************************
+
+func QuantileOverWindow(g Analytics, promise string, from, to int64, q float64) (float64,int64) {
+
+	// e.g. p99 latency of a promise over the last hour
+	//   now := time.Now().Unix()
+	//   p99,samples := QuantileOverWindow(g,ctx.Name,now-3600,now,0.99)
+
+	s := GetWindowSketch(g,promise,from,to)
+
+	return SketchQuantile(s,q), s.Total
+}
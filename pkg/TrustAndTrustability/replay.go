@@ -0,0 +1,351 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Deterministic replay of timestamped event logs through the promise machinery
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ****************************************************************************
+// A log of (promise, start, end, quality) records is played back through
+// StampedPromiseContext_Begin/End and AssessPromiseByPolicy with CLOCK set to
+// each recorded time, so histories, weekly memory and reliability come out
+// exactly as if the events had happened live. Times may be RFC3339 or Unix
+// seconds (fractions allowed). CSV has the columns
+//
+//   promise,start,end,quality
+//
+// and JSONL has one object per line with the same field names.
+// ****************************************************************************
+
+type ReplayEvent struct {
+
+	Promise string
+	Start   time.Time
+	End     time.Time
+	Quality float64
+}
+
+// ****************************************************************************
+
+type ReplayOptions struct {
+
+	Reset  bool    // truncate the promise collections first, for a clean rebuild
+	Weekly string  // optional collection for a weekly latency memory (LearnWeeklyKV)
+}
+
+// ****************************************************************************
+
+type ReplaySummary struct {
+
+	Events      int
+	First       time.Time
+	Last        time.Time
+	Reliability map[string]float64  // final reliability by promise name
+}
+
+// ****************************************************************************
+
+var REPLAY_COLLECTIONS = []string{ "BeginEndLocks", "PromiseKeeping", "conn", OUTCOME_COLLECTION, SKETCH_COLLECTION, BUDGET_COLLECTION }
+
+// ****************************************************************************
+
+func ReadReplayLog(filename string) ([]ReplayEvent,error) {
+
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	if strings.HasSuffix(filename,".jsonl") || strings.HasSuffix(filename,".json") {
+		return ParseReplayJSONL(f)
+	}
+
+	return ParseReplayCSV(f)
+}
+
+// ****************************************************************************
+
+func ParseReplayCSV(r io.Reader) ([]ReplayEvent,error) {
+
+	var events []ReplayEvent
+
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for line := range records {
+
+		rec := records[line]
+
+		if line == 0 && strings.ToLower(rec[0]) == "promise" {
+			continue // header
+		}
+
+		if len(rec) < 4 {
+			return nil, fmt.Errorf("replay log line %d: expected promise,start,end,quality",line+1)
+		}
+
+		ev, err := MakeReplayEvent(rec[0],rec[1],rec[2],rec[3])
+
+		if err != nil {
+			return nil, fmt.Errorf("replay log line %d: %v",line+1,err)
+		}
+
+		events = append(events,ev)
+	}
+
+	return events, nil
+}
+
+// ****************************************************************************
+
+func ParseReplayJSONL(r io.Reader) ([]ReplayEvent,error) {
+
+	var events []ReplayEvent
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		var rec map[string]interface{}
+
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+
+		if err := decoder.Decode(&rec); err != nil {
+			return nil, fmt.Errorf("replay log line %d: %v",line,err)
+		}
+
+		field := func(k string) string {
+			if rec[k] == nil {
+				return ""
+			}
+			return fmt.Sprint(rec[k])
+		}
+
+		ev, err := MakeReplayEvent(field("promise"),field("start"),field("end"),field("quality"))
+
+		if err != nil {
+			return nil, fmt.Errorf("replay log line %d: %v",line,err)
+		}
+
+		events = append(events,ev)
+	}
+
+	return events, scanner.Err()
+}
+
+// ****************************************************************************
+
+func MakeReplayEvent(promise,start,end,quality string) (ReplayEvent,error) {
+
+	var ev ReplayEvent
+	var err error
+
+	ev.Promise = strings.TrimSpace(promise)
+
+	if ev.Promise == "" {
+		return ev, fmt.Errorf("missing promise name")
+	}
+
+	if ev.Start, err = ParseReplayTime(start); err != nil {
+		return ev, err
+	}
+
+	if ev.End, err = ParseReplayTime(end); err != nil {
+		return ev, err
+	}
+
+	if ev.End.Before(ev.Start) {
+		return ev, fmt.Errorf("promise %s ends before it starts",ev.Promise)
+	}
+
+	if ev.Quality, err = strconv.ParseFloat(strings.TrimSpace(quality),64); err != nil {
+		return ev, fmt.Errorf("bad quality \"%s\"",quality)
+	}
+
+	return ev, nil
+}
+
+// ****************************************************************************
+
+func ParseReplayTime(s string) (time.Time,error) {
+
+	s = strings.TrimSpace(s)
+
+	if t, err := time.Parse(time.RFC3339Nano,s); err == nil {
+		return t, nil
+	}
+
+	secs, err := strconv.ParseFloat(s,64)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time \"%s\", expected RFC3339 or Unix seconds",s)
+	}
+
+	whole, frac := math.Modf(secs)
+
+	return time.Unix(int64(whole),int64(math.Round(frac * NANO))), nil
+}
+
+// ****************************************************************************
+
+func ReplayPromiseLog(g Analytics, events []ReplayEvent, opts ReplayOptions) ReplaySummary {
+
+	// Interleave begins and ends in time order, as they would have happened
+
+	type step struct {
+		t     time.Time
+		begin bool
+		index int
+	}
+
+	var steps []step
+	var summary ReplaySummary
+
+	summary.Reliability = make(map[string]float64)
+	summary.Events = len(events)
+
+	for i := range events {
+		steps = append(steps,step{ events[i].Start, true, i })
+		steps = append(steps,step{ events[i].End, false, i })
+	}
+
+	// At equal times, ends release their locks before new begins
+
+	sort.SliceStable(steps, func(i, j int) bool {
+
+		if !steps[i].t.Equal(steps[j].t) {
+			return steps[i].t.Before(steps[j].t)
+		}
+
+		if steps[i].begin != steps[j].begin {
+			return !steps[i].begin
+		}
+
+		return steps[i].index < steps[j].index
+	})
+
+	if len(steps) > 0 {
+		summary.First = steps[0].t
+		summary.Last = steps[len(steps)-1].t
+	}
+
+	if opts.Reset {
+		ResetReplayCollections(g,opts)
+	}
+
+	// Locks are kept privately for the replay, and all "now"s come from the log
+
+	saved_locker := SetLocker(NewInProcessLocker())
+
+	clock := &ReplayClock{}
+	saved_clock := SetClock(clock)
+
+	defer func() {
+		SetClock(saved_clock)
+		SetLocker(saved_locker)
+	}()
+
+	contexts := make(map[int]PromiseContext)
+
+	for _,s := range steps {
+
+		clock.Set(s.t)
+		ev := events[s.index]
+
+		if s.begin {
+			contexts[s.index] = StampedPromiseContext_Begin(g,ev.Promise,ev.Start)
+			continue
+		}
+
+		e := StampedPromiseContext_End(g,contexts[s.index],ev.End)
+		delete(contexts,s.index)
+
+		if opts.Weekly != "" {
+			LearnWeeklyKV(g,opts.Weekly,ev.End.Unix(),ev.End.Sub(ev.Start).Seconds())
+		}
+
+		summary.Reliability[PromiseNameOf(ev.Promise)] = AssessPromiseByPolicy(g,e,ev.Quality)
+	}
+
+	return summary
+}
+
+// ****************************************************************************
+
+func ResetReplayCollections(g Analytics, opts ReplayOptions) {
+
+	colls := REPLAY_COLLECTIONS
+
+	if opts.Weekly != "" {
+		colls = append(colls,opts.Weekly)
+	}
+
+	for _,name := range colls {
+
+		exists,_ := g.S_db.CollectionExists(nil,name)
+
+		if !exists {
+			continue
+		}
+
+		coll, err := g.S_db.Collection(nil,name)
+
+		if err == nil {
+			err = coll.Truncate(nil)
+		}
+
+		if err != nil {
+			fmt.Println("Replay couldn't reset collection",name,err)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Rules - context expressions that trigger actions, with an audit trail
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// ****************************************************************************
+// Contexts accumulate evidence; rules act on it. Each rule pairs a context
+// expression with a confidence threshold and an action, e.g.
+//
+// {
+//   "semantics": "zadeh",
+//   "rules": [
+//     { "name": "vandalism", "when": "large_deletion & counter_policy_message",
+//       "action": "adjust_trust", "target": "wikipedia", "value": -0.2 },
+//     { "name": "contention", "when": "state_of_contention & !holiday", "threshold": 0.8,
+//       "action": "sampling_rate", "target": "wikipedia", "value": 4 },
+//     { "name": "odd", "when": "anomalous_message", "action": "alert", "target": "odd message", "ifelapsed": 3600 },
+//     { "name": "edit_war", "when": "explicit_undo.effective_undo", "action": "tag", "target": "edit_war" }
+//   ]
+// }
+//
+// adjust_trust adds value to the reliability of the target promise (clamped
+// to [0,1]) when it is next assessed, sampling_rate asks for the target to be sampled value times as
+// often, alert prints the target message, and tag raises the target class,
+// so that it is kept with the episode. More actions can be registered.
+// A rule fires at most once per ifelapsed seconds. Every firing is kept in
+// the engine's audit list, written to the RuleFirings collection, and, if
+// TT.RULE_AUDIT_FILE is set, appended to that file as JSON lines.
+// ****************************************************************************
+
+const RULE_ADJUST_TRUST = "adjust_trust"
+const RULE_SAMPLING_RATE = "sampling_rate"
+const RULE_ALERT = "alert"
+const RULE_TAG = "tag"
+
+const RULE_THRESHOLD = 0.5        // default confidence needed to fire
+const RULE_AUDIT_MAX = 1000       // firings kept in memory
+const RULE_FIRINGS = "RuleFirings"
+
+// ****************************************************************************
+
+type Rule struct {
+
+	Name      string  `json:"name"`
+	When      string  `json:"when"`       // context expression
+	Threshold float64 `json:"threshold"`  // 0 = RULE_THRESHOLD
+	Semantics string  `json:"semantics"`  // "" = the rule set's
+	Action    string  `json:"action"`
+	Target    string  `json:"target"`
+	Value     float64 `json:"value"`
+	IfElapsed int64   `json:"ifelapsed"`  // min seconds between firings
+
+	expr      *ContextExpression
+}
+
+// ****************************************************************************
+
+type RuleSet struct {
+
+	Semantics string `json:"semantics"`  // "" = the context store's
+	Rules     []Rule `json:"rules"`
+}
+
+// ****************************************************************************
+
+type RuleFiring struct {
+
+	Key        string   `json:"_key"`
+	Rule       string   `json:"rule"`
+	When       string   `json:"when"`
+	Confidence float64  `json:"confidence"`
+	Threshold  float64  `json:"threshold"`
+	Action     string   `json:"action"`
+	Target     string   `json:"target"`
+	Value      float64  `json:"value"`
+	Episode    string   `json:"episode"`
+	Time       int64    `json:"time"`
+	Context    []string `json:"context"`   // the classes present when it fired
+	Result     string   `json:"result"`    // what the action did
+	Error      string   `json:"error"`
+}
+
+// ****************************************************************************
+
+type RuleAction func(g Analytics, cs *ContextStore, f RuleFiring) (string,error)
+
+var RULE_ACTIONS = map[string]RuleAction{
+
+	RULE_ADJUST_TRUST:  AdjustTrustAction,
+	RULE_SAMPLING_RATE: SamplingRateAction,
+	RULE_ALERT:         AlertAction,
+	RULE_TAG:           TagAction,
+}
+
+// ****************************************************************************
+
+type RuleEngine struct {
+
+	mutex  sync.Mutex
+	rules  RuleSet
+	last   map[string]int64   // when each rule last fired
+	audit  []RuleFiring
+}
+
+var RULES = NewRuleEngine()
+
+var RULE_AUDIT_FILE string
+
+// ****************************************************************************
+
+func NewRuleEngine() *RuleEngine {
+
+	return &RuleEngine{ last: make(map[string]int64) }
+}
+
+// ****************************************************************************
+
+func LoadRules(filename string) (RuleSet,error) {
+
+	// Read a JSON rule file, check it and make it current in TT.RULES
+
+	var rules RuleSet
+
+	content, err := os.ReadFile(filename)
+
+	if err != nil {
+		return rules, err
+	}
+
+	if err = json.Unmarshal(content,&rules); err != nil {
+		return rules, fmt.Errorf("rules %s: %v",filename,err)
+	}
+
+	if err = SetRules(RULES,rules); err != nil {
+		return rules, fmt.Errorf("rules %s: %v",filename,err)
+	}
+
+	return rules, nil
+}
+
+// ****************************************************************************
+
+func SetRules(re *RuleEngine, rules RuleSet) error {
+
+	// Compile and check everything before replacing anything
+
+	if rules.Semantics != "" {
+		if err := ValidFuzzySemantics(rules.Semantics); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for i := range rules.Rules {
+
+		r := &rules.Rules[i]
+
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule_%d",i+1)
+		}
+
+		if names[r.Name] {
+			return fmt.Errorf("rule %s is defined twice",r.Name)
+		}
+
+		names[r.Name] = true
+
+		expr, err := CompileContext(r.When)
+
+		if err != nil {
+			return fmt.Errorf("rule %s: %v",r.Name,err)
+		}
+
+		r.expr = expr
+
+		if _,ok := RULE_ACTIONS[r.Action]; !ok {
+			return fmt.Errorf("rule %s: unknown action \"%s\"",r.Name,r.Action)
+		}
+
+		if r.Semantics != "" {
+			if err := ValidFuzzySemantics(r.Semantics); err != nil {
+				return fmt.Errorf("rule %s: %v",r.Name,err)
+			}
+		}
+
+		if r.Threshold == 0 {
+			r.Threshold = RULE_THRESHOLD
+		}
+	}
+
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	re.rules = rules
+	re.last = make(map[string]int64)
+
+	return nil
+}
+
+// ****************************************************************************
+
+func RegisterRuleAction(name string, action RuleAction) {
+
+	RULE_ACTIONS[name] = action
+}
+
+// ****************************************************************************
+
+func EvaluateRules(g Analytics, re *RuleEngine, cs *ContextStore, episode string, now int64) []RuleFiring {
+
+	// Fire every rule whose expression is confident enough in the context
+	// now, and record what happened
+
+	var fired []RuleFiring
+
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	values := ContextStoreValues(cs,now)
+	set := ContextStoreSet(cs,now)
+
+	for _,r := range re.rules.Rules {
+
+		semantics := FirstNonEmpty(r.Semantics,re.rules.Semantics,cs.Semantics,CONTEXT_SEMANTICS)
+		confidence := EvalContextWith(r.expr,values,semantics)
+
+		if confidence < r.Threshold {
+			continue
+		}
+
+		if last, ok := re.last[r.Name]; ok && (now - last) / NANO < r.IfElapsed {
+			continue
+		}
+
+		re.last[r.Name] = now
+
+		f := RuleFiring{ Rule: r.Name, When: r.When, Confidence: confidence, Threshold: r.Threshold,
+			Action: r.Action, Target: r.Target, Value: r.Value, Episode: episode, Time: now, Context: set }
+
+		f.Key = DocumentKey(fmt.Sprintf("%s_%d",r.Name,now))
+
+		result, err := RULE_ACTIONS[r.Action](g,cs,f)
+
+		f.Result = result
+
+		if err != nil {
+			f.Error = err.Error()
+			fmt.Println("Rule",r.Name,"failed to",r.Action,r.Target,err)
+		}
+
+		Println("Rule",r.Name,"fired on",r.When,"confidence",confidence,":",r.Action,r.Target,result)
+
+		AuditRuleFiring(g,re,f)
+		fired = append(fired,f)
+	}
+
+	return fired
+}
+
+// ****************************************************************************
+
+func AuditRuleFiring(g Analytics, re *RuleEngine, f RuleFiring) {
+
+	// Called with the engine locked
+
+	re.audit = append(re.audit,f)
+
+	if len(re.audit) > RULE_AUDIT_MAX {
+		re.audit = re.audit[len(re.audit)-RULE_AUDIT_MAX:]
+	}
+
+	if g.S_db != nil {
+		SaveDocument(g,RULE_FIRINGS,f.Key,f)
+	}
+
+	if RULE_AUDIT_FILE != "" {
+
+		line, err := json.Marshal(f)
+
+		if err != nil {
+			fmt.Println("Couldn't audit rule firing",f.Rule,err)
+			return
+		}
+
+		AppendStringToFile(RULE_AUDIT_FILE,string(line) + "\n")
+	}
+}
+
+// ****************************************************************************
+
+func RuleAudit(re *RuleEngine) []RuleFiring {
+
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	return append([]RuleFiring(nil),re.audit...)
+}
+
+// ****************************************************************************
+
+func FirstNonEmpty(s ...string) string {
+
+	for _,v := range s {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// ****************************************************************************
+// Actions
+// ****************************************************************************
+
+func AdjustTrustAction(g Analytics, cs *ContextStore, f RuleFiring) (string,error) {
+
+	// Reliability is kept per assessment (name:timeslot), so the adjustment
+	// is held against the promise name until its next assessment applies it
+
+	name := PromiseNameOf(f.Target)
+
+	if name == "" {
+		return "", fmt.Errorf("no target promise")
+	}
+
+	TRUST_MUTEX.Lock()
+	defer TRUST_MUTEX.Unlock()
+
+	TRUST_OFFSET[name] += f.Value
+
+	return fmt.Sprintf("trust offset %.3f pending for %s",TRUST_OFFSET[name],name), nil
+}
+
+// ****************************************************************************
+
+var TRUST_OFFSET = make(map[string]float64)
+var TRUST_MUTEX sync.Mutex
+
+// ****************************************************************************
+
+func ApplyTrustOffset(name string, reliability float64) float64 {
+
+	// Add, once, what adjust_trust rules have asked for since the promise
+	// was last assessed. name may be a promise name or a PromiseHistory key
+
+	TRUST_MUTEX.Lock()
+	defer TRUST_MUTEX.Unlock()
+
+	key := PromiseNameOf(name)
+	offset, ok := TRUST_OFFSET[key]
+
+	if !ok {
+		return reliability
+	}
+
+	delete(TRUST_OFFSET,key)
+
+	Println("Adjusting reliability of",key,"by",offset)
+
+	return math.Max(0,math.Min(1,reliability + offset))
+}
+
+// ****************************************************************************
+
+var SAMPLING_FACTOR = make(map[string]float64)
+var SAMPLING_MUTEX sync.Mutex
+
+// ****************************************************************************
+
+func SamplingRateAction(g Analytics, cs *ContextStore, f RuleFiring) (string,error) {
+
+	if f.Value <= 0 {
+		return "", fmt.Errorf("sampling rate factor should be > 0, not %f",f.Value)
+	}
+
+	SAMPLING_MUTEX.Lock()
+	defer SAMPLING_MUTEX.Unlock()
+
+	SAMPLING_FACTOR[KeyName(f.Target,0)] = f.Value
+
+	return fmt.Sprintf("sampling x%.2f",f.Value), nil
+}
+
+// ****************************************************************************
+
+func MonitoringInterval(name string) float64 {
+
+	// The policy's trust_interval, shortened by any sampling_rate rule.
+	// name may be a promise name or a PromiseHistory key (name:timeslot)
+
+	interval := GetPromisePolicy(name).TrustInterval
+
+	SAMPLING_MUTEX.Lock()
+	defer SAMPLING_MUTEX.Unlock()
+
+	if factor, ok := SAMPLING_FACTOR[PromiseNameOf(name)]; ok {
+		interval /= factor
+	}
+
+	return interval
+}
+
+// ****************************************************************************
+
+func AlertAction(g Analytics, cs *ContextStore, f RuleFiring) (string,error) {
+
+	fmt.Println("ALERT",f.Rule,":",f.Target,"(",f.When,"confidence",f.Confidence,"episode",f.Episode,")")
+
+	return "alerted", nil
+}
+
+// ****************************************************************************
+
+func TagAction(g Analytics, cs *ContextStore, f RuleFiring) (string,error) {
+
+	tag := ClassName(f.Target)
+
+	if tag == "" {
+		return "", fmt.Errorf("no tag")
+	}
+
+	ContextStoreAdd(cs,tag,f.Time)
+
+	return "tagged " + tag, nil
+}
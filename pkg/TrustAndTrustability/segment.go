@@ -0,0 +1,231 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Sentence segmentation - which full stops end a sentence
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ****************************************************************************
+// Sentences are the clock of the fractionator: legs are counted in them, so
+// false sentence ends from "e.g.", "Dr. Smith", "3.5" or "wait... what"
+// distort leg boundaries and rankings. After cleaning, every sentence ends in
+// a run of . ! or ?, and a Segmenter decides which of those runs really end
+// a sentence:
+//
+//   punctuation - every run, as the fractionator always did
+//   rules       - not after the language pack's abbreviations or initials,
+//                 not inside numbers, names or addresses (3.5, example.com),
+//                 and not at an ellipsis that the sentence carries on from
+//
+// A fractionator picks its segmenter by name in its config. With no name it
+// uses rules when it has a language pack, and punctuation otherwise.
+// ****************************************************************************
+
+const SEGMENTER_PUNCTUATION = "punctuation"
+const SEGMENTER_RULES = "rules"
+
+// ****************************************************************************
+
+type Segmenter interface {
+
+	// Does the run of terminators text[start:end] end a sentence?
+
+	EndsSentence(text string, start, end int, pack *LanguagePack) bool
+}
+
+// ****************************************************************************
+
+var SEGMENTERS = map[string]Segmenter{
+
+	SEGMENTER_PUNCTUATION: PunctuationSegmenter{},
+	SEGMENTER_RULES:       RuleSegmenter{},
+}
+
+var TERMINATOR_RUN = regexp.MustCompile("[?!.]+")
+
+// ****************************************************************************
+
+func RegisterSegmenter(name string, s Segmenter) {
+
+	SEGMENTERS[name] = s
+}
+
+// ****************************************************************************
+
+func SegmenterNamed(name string) Segmenter {
+
+	if s, ok := SEGMENTERS[name]; ok {
+		return s
+	}
+
+	return PunctuationSegmenter{}
+}
+
+// ****************************************************************************
+
+type PunctuationSegmenter struct{}
+
+// ****************************************************************************
+
+func (PunctuationSegmenter) EndsSentence(text string, start, end int, pack *LanguagePack) bool {
+
+	return true
+}
+
+// ****************************************************************************
+
+type RuleSegmenter struct{}
+
+// ****************************************************************************
+
+func (RuleSegmenter) EndsSentence(text string, start, end int, pack *LanguagePack) bool {
+
+	if pack == nil {
+		pack = LanguagePackNamed(LANGUAGE_DEFAULT)
+	}
+
+	run := text[start:end]
+
+	// Either side of the run, and the first character after any spaces
+
+	prev, _ := utf8.DecodeLastRuneInString(text[:start])
+	next, _ := utf8.DecodeRuneInString(text[end:])
+	after := strings.TrimLeft(text[end:]," \t\n")
+	first, _ := utf8.DecodeRuneInString(after)
+
+	if end == len(text) || len(after) == 0 {
+		return true
+	}
+
+	// Inside a number, name or address, e.g. 3.5, e.g, example.com, but
+	// not between sentences of scripts written without spaces
+
+	if (unicode.IsLetter(next) || unicode.IsDigit(next)) && !IsCJK(next) && !IsCJK(prev) {
+		return false
+	}
+
+	if strings.ContainsAny(run,"!?") {
+		return true
+	}
+
+	// An ellipsis that the sentence carries on from... like this
+
+	if len(run) > 1 && unicode.IsLower(first) {
+		return false
+	}
+
+	// The word before, e.g. "Dr" or "(e.g"
+
+	word := text[:start]
+
+	if i := strings.LastIndexAny(word," \t\n("); i >= 0 {
+		word = word[i+1:]
+	}
+
+	if run == "." && pack.abbreviations[strings.ToLower(word) + "."] {
+		return false
+	}
+
+	// An initial, e.g. J. R. R. Tolkien
+
+	if run == "." && utf8.RuneCountInString(word) == 1 {
+
+		r, _ := utf8.DecodeRuneInString(word)
+
+		if unicode.IsUpper(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ****************************************************************************
+
+func SegmentSentences(text string, seg Segmenter, pack *LanguagePack) []string {
+
+	// Split clean text (without # markers) into sentences, each ending
+	// with its terminators
+
+	var sentences []string
+
+	begin := 0
+
+	for _,run := range TERMINATOR_RUN.FindAllStringIndex(text,-1) {
+
+		if seg.EndsSentence(text,run[0],run[1],pack) {
+
+			if s := strings.TrimSpace(text[begin:run[1]]); len(s) > 0 {
+				sentences = append(sentences,s)
+			}
+
+			begin = run[1]
+		}
+	}
+
+	if s := strings.TrimSpace(text[begin:]); len(s) > 0 {
+		sentences = append(sentences,s)
+	}
+
+	return sentences
+}
+
+// ****************************************************************************
+
+func MarkSentenceEnds(text string, seg Segmenter, pack *LanguagePack) string {
+
+	// Encode end of sentence markers with a # for later splitting
+	// (see SplitIntoSentences)
+
+	var b strings.Builder
+
+	begin := 0
+
+	for _,run := range TERMINATOR_RUN.FindAllStringIndex(text,-1) {
+
+		if seg.EndsSentence(text,run[0],run[1],pack) {
+			b.WriteString(text[begin:run[1]])
+			b.WriteString("#")
+			begin = run[1]
+		}
+	}
+
+	b.WriteString(text[begin:])
+
+	return b.String()
+}
+
+// ****************************************************************************
+
+func DefaultSegmenter(pack *LanguagePack) Segmenter {
+
+	if pack != nil {
+		return RuleSegmenter{}
+	}
+
+	return PunctuationSegmenter{}
+}
@@ -0,0 +1,425 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Agent based simulation, to test trust assessment against a known truth
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ****************************************************************************
+// Agents keep, partially keep or break a promise with a known probability,
+// which may drift or be subverted by an attack. An observer for each agent
+// learns from the outcomes with the same NextPromiseHistory/UpdateReliability
+// steps (and promise policy) as the live system, and we compare its estimate
+// of reliability with the ground truth at every step. Everything is driven
+// from one seeded random source, so a run is exactly reproducible.
+// ****************************************************************************
+
+const ATTACK_NONE = ""
+const ATTACK_BETRAYAL = "betrayal"  // build up trust, then break every promise
+const ATTACK_ON_OFF = "on_off"      // alternate honest and broken phases
+
+const SIM_BROKEN_LATENCY = 3.0  // a broken promise times out at this multiple of the bound
+const SIM_PARTIAL_QUALITY = 0.5
+
+// ****************************************************************************
+
+type SimAttack struct {
+
+	Kind   string `json:"kind"`    // ATTACK_BETRAYAL or ATTACK_ON_OFF
+	Start  int    `json:"start"`   // step at which it begins
+	Period int    `json:"period"`  // length of each on/off phase, steps
+}
+
+// ****************************************************************************
+
+type SimAgent struct {
+
+	Name        string     `json:"name"`
+	Reliability float64    `json:"reliability"` // probability of keeping the promise at step 0
+	Partial     float64    `json:"partial"`     // probability that a promise not kept is kept partially
+	Latency     float64    `json:"latency"`     // mean response time when kept (s)
+	Jitter      float64    `json:"jitter"`      // relative standard deviation of latency
+	Drift       float64    `json:"drift"`       // change of reliability per step
+	Attack      *SimAttack `json:"attack"`
+}
+
+// ****************************************************************************
+
+type SimulationConfig struct {
+
+	Seed      int64      `json:"seed"`
+	Steps     int        `json:"steps"`
+	Interval  float64    `json:"interval"`   // seconds between interactions
+	Tolerance float64    `json:"tolerance"`  // estimate counts as on track within this of the truth
+	Agents    []SimAgent `json:"agents"`
+
+	Diagnostics bool     `json:"diagnostics"` // print UpdateReliability's running commentary for every step
+}
+
+// ****************************************************************************
+
+type SimSample struct {
+
+	Step      int
+	Truth     float64
+	Estimate  float64
+	Latency   float64
+	Quality   float64
+	Anomalies int
+}
+
+// ****************************************************************************
+
+type SimAgentResult struct {
+
+	Name       string
+	Samples    []SimSample
+
+	MAE        float64  // mean absolute error of the estimate
+	RMSE       float64
+	FinalError float64
+	MeanLag    float64  // mean steps to get within tolerance after a change of truth
+	Settled    int      // changes of truth that were caught up with
+	Unsettled  int      // changes the estimate never caught up with
+	Anomalies  int      // anomaly events raised by the history detectors
+}
+
+// ****************************************************************************
+
+type SimulationResult struct {
+
+	Config SimulationConfig
+	Agents []SimAgentResult
+}
+
+// ****************************************************************************
+
+// A fixed epoch, so that timestamps (and DoughNowt slots) are reproducible too
+
+var SIM_EPOCH = time.Date(2023,time.January,2,0,0,0,0,time.UTC)
+
+// ****************************************************************************
+
+func DefaultSimulation() SimulationConfig {
+
+	return SimulationConfig{
+
+		Seed:      1,
+		Steps:     500,
+		Interval:  60,
+		Tolerance: 0.1,
+		Agents: []SimAgent{
+
+			{ Name: "honest",   Reliability: 0.95, Partial: 0.5, Latency: 0.4, Jitter: 0.2 },
+			{ Name: "flaky",    Reliability: 0.6,  Partial: 0.5, Latency: 0.8, Jitter: 0.5 },
+			{ Name: "drifting", Reliability: 0.95, Partial: 0.2, Latency: 0.5, Jitter: 0.2, Drift: -0.0015 },
+			{ Name: "betrayer", Reliability: 0.95, Partial: 0.2, Latency: 0.4, Jitter: 0.2, Attack: &SimAttack{ Kind: ATTACK_BETRAYAL, Start: 250 } },
+			{ Name: "on_off",   Reliability: 0.95, Partial: 0.2, Latency: 0.4, Jitter: 0.2, Attack: &SimAttack{ Kind: ATTACK_ON_OFF, Start: 100, Period: 50 } },
+		},
+	}
+}
+
+// ****************************************************************************
+
+func LoadSimulationConfig(filename string) (SimulationConfig,error) {
+
+	// Unset fields keep the values of DefaultSimulation, except the agents
+
+	config := DefaultSimulation()
+
+	content, err := os.ReadFile(filename)
+
+	if err != nil {
+		return config, err
+	}
+
+	if err = json.Unmarshal(content,&config); err != nil {
+		return config, fmt.Errorf("simulation config %s: %v",filename,err)
+	}
+
+	for i,a := range config.Agents {
+
+		if a.Name == "" {
+			return config, fmt.Errorf("simulation config %s: agent %d has no name",filename,i)
+		}
+
+		if a.Attack != nil && a.Attack.Kind != ATTACK_BETRAYAL && a.Attack.Kind != ATTACK_ON_OFF {
+			return config, fmt.Errorf("simulation config %s: unknown attack \"%s\"",filename,a.Attack.Kind)
+		}
+	}
+
+	return config, nil
+}
+
+// ****************************************************************************
+
+func AgentTruth(a SimAgent, step int) float64 {
+
+	// Probability of keeping the promise at this step, before partial credit
+
+	p := a.Reliability + a.Drift * float64(step)
+
+	if a.Attack != nil && step >= a.Attack.Start {
+
+		switch a.Attack.Kind {
+
+		case ATTACK_BETRAYAL:
+			p = 0
+
+		case ATTACK_ON_OFF:
+			period := a.Attack.Period
+
+			if period < 1 {
+				period = 1
+			}
+
+			if ((step - a.Attack.Start) / period) % 2 == 0 {
+				p = 0
+			}
+		}
+	}
+
+	return math.Max(0,math.Min(1,p))
+}
+
+// ****************************************************************************
+
+func GroundTruth(a SimAgent, step int) float64 {
+
+	// The expected degree of promise keeping, counting partial outcomes
+
+	p := AgentTruth(a,step)
+
+	return p + (1 - p) * a.Partial * SIM_PARTIAL_QUALITY
+}
+
+// ****************************************************************************
+
+func AgentOutcome(r *rand.Rand, a SimAgent, step int, upper_bound float64) (float64,float64) {
+
+	// Returns the latency (s) and assessed quality of one interaction
+
+	p := AgentTruth(a,step)
+
+	latency := a.Latency * (1 + a.Jitter * r.NormFloat64())
+	latency = math.Max(latency,0.01 * a.Latency)
+
+	x := r.Float64()
+
+	if x < p {
+		return latency, 1
+	}
+
+	if x < p + (1 - p) * a.Partial {
+		return latency, SIM_PARTIAL_QUALITY
+	}
+
+	return SIM_BROKEN_LATENCY * upper_bound, 0
+}
+
+// ****************************************************************************
+
+func RunSimulation(config SimulationConfig) SimulationResult {
+
+	var result SimulationResult
+
+	result.Config = config
+
+	// The assessment reports each step, as the live servers want, which
+	// for thousands of simulated steps is only noise
+
+	var commentary io.Writer = io.Discard
+
+	if config.Diagnostics {
+		commentary = os.Stdout
+	}
+
+	r := rand.New(rand.NewSource(config.Seed))
+
+	type observer struct {
+		history     PromiseHistory
+		exists      bool
+		reliability float64
+		policy      PromisePolicy
+		windows     map[int64]QuantileSketch  // as PromiseSketches, for quantile promises
+	}
+
+	observers := make([]observer,len(config.Agents))
+
+	for i,a := range config.Agents {
+		observers[i].policy = GetPromisePolicy(a.Name)
+		observers[i].windows = make(map[int64]QuantileSketch)
+		result.Agents = append(result.Agents,SimAgentResult{ Name: a.Name })
+	}
+
+	for step := 0; step < config.Steps; step++ {
+
+		now := SIM_EPOCH.UnixNano() + int64(float64(step) * config.Interval * NANO)
+
+		for i,a := range config.Agents {
+
+			o := &observers[i]
+			key := PromiseNameOf(a.Name)
+
+			latency,quality := AgentOutcome(r,a,step,o.policy.UpperBound)
+
+			o.history = NextPromiseHistory(o.history,o.exists,key,now,latency * NANO,"ns",o.policy.HistoryRate)
+			o.exists = true
+
+			window := o.windows[WindowStart(now)]
+			SketchAdd(&window,latency * NANO)
+			o.windows[WindowStart(now)] = window
+			o.history.Recent = RecentSketch(o.windows,now)
+
+			o.reliability,_ = UpdateReliability(commentary,o.reliability,o.history,quality,o.policy.UpperBound,MonitoringInterval(key),o.policy)
+
+			sample := SimSample{
+				Step:      step,
+				Truth:     GroundTruth(a,step),
+				Estimate:  o.reliability,
+				Latency:   latency,
+				Quality:   quality,
+				Anomalies: len(o.history.Anomalies),
+			}
+
+			result.Agents[i].Samples = append(result.Agents[i].Samples,sample)
+		}
+	}
+
+	for i := range result.Agents {
+		result.Agents[i] = ScoreSimulation(result.Agents[i],config.Tolerance)
+	}
+
+	return result
+}
+
+// ****************************************************************************
+
+func ScoreSimulation(res SimAgentResult, tolerance float64) SimAgentResult {
+
+	// How accurately, and how quickly, did the estimate track the truth?
+
+	var sum_abs,sum_sq,sum_lag float64
+
+	pending := true
+	since := 0
+
+	for i,s := range res.Samples {
+
+		err := s.Estimate - s.Truth
+
+		sum_abs += math.Abs(err)
+		sum_sq += err * err
+		res.Anomalies += s.Anomalies
+
+		// A jump in the truth starts a new catch-up
+
+		if i > 0 && math.Abs(s.Truth - res.Samples[i-1].Truth) > tolerance {
+
+			if pending {
+				res.Unsettled++
+			}
+
+			pending = true
+			since = s.Step
+		}
+
+		if pending && math.Abs(err) <= tolerance {
+
+			sum_lag += float64(s.Step - since)
+			res.Settled++
+			pending = false
+		}
+	}
+
+	if pending {
+		res.Unsettled++
+	}
+
+	n := len(res.Samples)
+
+	if n > 0 {
+		res.MAE = sum_abs / float64(n)
+		res.RMSE = math.Sqrt(sum_sq / float64(n))
+		res.FinalError = res.Samples[n-1].Estimate - res.Samples[n-1].Truth
+	}
+
+	if res.Settled > 0 {
+		res.MeanLag = sum_lag / float64(res.Settled)
+	}
+
+	return res
+}
+
+// ****************************************************************************
+
+func WriteSimulationResults(dir string, result SimulationResult) error {
+
+	// As in data/ML, plain columns for gnuplot: one file per agent with
+	//   step truth estimate latency quality
+	// and summary.dat with one line per agent
+
+	if err := os.MkdirAll(dir,0755); err != nil {
+		return err
+	}
+
+	var summary,plots strings.Builder
+
+	fmt.Fprintf(&summary,"# seed %d steps %d interval %.1f tolerance %.3f\n",result.Config.Seed,result.Config.Steps,result.Config.Interval,result.Config.Tolerance)
+	fmt.Fprintf(&summary,"# index mae rmse mean_lag settled unsettled final_error anomalies agent\n")
+
+	for i,res := range result.Agents {
+
+		var series strings.Builder
+
+		for _,s := range res.Samples {
+			fmt.Fprintf(&series,"%d %f %f %f %f\n",s.Step,s.Truth,s.Estimate,s.Latency,s.Quality)
+		}
+
+		filename := KeyName(res.Name,0) + ".dat"
+
+		if err := os.WriteFile(filepath.Join(dir,filename),[]byte(series.String()),0644); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&summary,"%d %f %f %f %d %d %f %d %s\n",i,res.MAE,res.RMSE,res.MeanLag,res.Settled,res.Unsettled,res.FinalError,res.Anomalies,res.Name)
+
+		fmt.Fprintf(&plots,"set xlabel \"step\"\nset ylabel \"reliability\"\nset yrange [0:1.1]\nset term pdf monochrome\nset output \"%s.pdf\"\n",KeyName(res.Name,0))
+		fmt.Fprintf(&plots,"plot \"%s\" using 1:2 w line title \"truth\", \"%s\" using 1:3 w line title \"estimate\"\n\n",filename,filename)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir,"summary.dat"),[]byte(summary.String()),0644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir,"gnuplot.in"),[]byte(plots.String()),0644)
+}
@@ -0,0 +1,414 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Streaming fractionation - sentences in, events out, leg by leg
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// ****************************************************************************
+// For chat and log streams there is no whole text to look back over. A
+// FractionStream takes sentences as they arrive, updates the fractionator's
+// n-gram memory, and when a leg's worth of sentences is complete, selects its
+// events at once, e.g.
+//
+//   fs := TT.NewFractionStream(TT.NewFractionator(TT.FractionationConfig{ LegWindow: 10 }),"chat")
+//   err := TT.StreamReader(fs,os.Stdin,func(leg TT.PrismLeg, events []TT.PrismEvent) { ... })
+//
+// Differences from the batch prism: a leg's rank is relative to the best leg
+// so far rather than the best in the document, and the document length used
+// by Intentionality is the number of sentences seen so far. Memory is bounded:
+// n-gram counts fade by the config's Forget fraction per sentence (forgotten
+// below FORGET_FLOOR, with at most STREAM_MAX_NGRAMS per length), and
+// occurrences are kept only as far back as the longest recurrence distance
+// RankByIntent considers (the config's MaxRecurrence legs).
+// ****************************************************************************
+
+const FORGET_FLOOR = 0.5            // n-gram counts below this are forgotten
+const STREAM_MAX_NGRAMS = 50000     // per n-gram length
+const STREAM_MAX_SENTENCE = 64*1024 // bytes, longer runs without a terminator are cut
+
+// ****************************************************************************
+
+type FractionStream struct {
+
+	F          *Fractionator
+	Subject    string
+
+	Forget     float64  // fraction of each n-gram count forgotten per sentence
+	MaxNgrams  int      // per n-gram length
+
+	leg        []Narrative
+	leg_number int
+	sentences  int       // seen so far
+	best_leg   float64   // highest leg average rank so far
+	ltm        [MAXCLUSTERS]map[string][]int
+}
+
+// ****************************************************************************
+
+func NewFractionStream(f *Fractionator, subject string) *FractionStream {
+
+	fs := &FractionStream{ F: f, Subject: subject, Forget: f.Config.Forget, MaxNgrams: STREAM_MAX_NGRAMS }
+
+	for n := 1; n < MAXCLUSTERS; n++ {
+		fs.ltm[n] = make(map[string][]int)
+	}
+
+	return fs
+}
+
+// ****************************************************************************
+
+func StreamSentence(fs *FractionStream, sentence string) (PrismLeg,[]PrismEvent,bool) {
+
+	// Add one (clean) sentence. When it completes a leg, return the leg
+	// and the events selected from it
+
+	if len(sentence) == 0 {
+		return PrismLeg{},nil,false
+	}
+
+	s_idx := fs.sentences
+	fs.sentences++
+
+	rank := FractionatorRankSentence(fs.F,s_idx,sentence,fs.sentences,fs.ltm)
+
+	fs.leg = append(fs.leg,NarrationMarker(sentence,rank,s_idx))
+	fs.F.SentenceIndex++
+
+	if len(fs.leg) < fs.F.Config.LegWindow {
+		return PrismLeg{},nil,false
+	}
+
+	leg,events := StreamCompleteLeg(fs)
+
+	return leg,events,true
+}
+
+// ****************************************************************************
+
+func StreamFlush(fs *FractionStream) (PrismLeg,[]PrismEvent,bool) {
+
+	// Select from any final, short leg, e.g. when the stream ends
+
+	if len(fs.leg) == 0 {
+		return PrismLeg{},nil,false
+	}
+
+	leg,events := StreamCompleteLeg(fs)
+
+	return leg,events,true
+}
+
+// ****************************************************************************
+
+func StreamCompleteLeg(fs *FractionStream) (PrismLeg,[]PrismEvent) {
+
+	var rank_sum float64
+
+	sentence_id_by_rank := make(map[float64]int)
+
+	for i,n := range fs.leg {
+		rank_sum += n.rank
+		sentence_id_by_rank[n.rank] = i
+	}
+
+	av_rank := rank_sum / float64(len(fs.leg))
+
+	if av_rank > fs.best_leg {
+		fs.best_leg = av_rank
+	}
+
+	leg,events := FractionatorAnnotateLeg(fs.F,fs.Subject,fs.leg,fs.leg_number,sentence_id_by_rank,av_rank,fs.best_leg)
+
+	// The events are handed on, not kept
+
+	fs.F.Selections = fs.F.Selections[:0]
+
+	StreamForget(fs,len(fs.leg))
+
+	fs.leg = nil
+	fs.leg_number++
+
+	return leg,events
+}
+
+// ****************************************************************************
+
+func StreamForget(fs *FractionStream, sentences int) {
+
+	// Fade the n-gram memory, and drop occurrences beyond the horizon
+
+	decay := math.Pow(1 - fs.Forget,float64(sentences))
+	horizon := fs.sentences - StreamHorizon(fs)
+
+	for n := 1; n < MAXCLUSTERS; n++ {
+
+		stm := fs.F.STM[n]
+
+		for ngram := range stm {
+
+			stm[ngram] *= decay
+
+			if stm[ngram] < FORGET_FLOOR {
+				delete(stm,ngram)
+			}
+		}
+
+		if fs.MaxNgrams > 0 && len(stm) > fs.MaxNgrams {
+			ForgetWeakest(stm,len(stm) - fs.MaxNgrams)
+		}
+
+		for ngram,occurrences := range fs.ltm[n] {
+
+			keep := sort.SearchInts(occurrences,horizon)
+
+			if keep == len(occurrences) {
+				delete(fs.ltm[n],ngram)
+			} else if keep > 0 {
+				fs.ltm[n][ngram] = append([]int(nil),occurrences[keep:]...)
+			}
+		}
+	}
+}
+
+// ****************************************************************************
+
+func StreamHorizon(fs *FractionStream) int {
+
+	// Sentences of occurrences kept
+
+	return int(math.Ceil(fs.F.Config.MaxRecurrence * float64(fs.F.Config.LegWindow)))
+}
+
+// ****************************************************************************
+
+func ForgetWeakest(stm map[string]float64, count int) {
+
+	var sortable []Score
+
+	for ngram,v := range stm {
+		sortable = append(sortable,Score{ Key: ngram, Score: v })
+	}
+
+	sort.Slice(sortable, func(i, j int) bool {
+		return sortable[i].Score < sortable[j].Score
+	})
+
+	for i := 0; i < count && i < len(sortable); i++ {
+		delete(stm,sortable[i].Key)
+	}
+}
+
+// ****************************************************************************
+
+func StreamTopics(fs *FractionStream) [MAXCLUSTERS]map[string]float64 {
+
+	// The persistent concepts within the horizon, measured from its start
+
+	var recent [MAXCLUSTERS]map[string][]int
+
+	base := fs.sentences - StreamHorizon(fs)
+
+	if base < 0 {
+		base = 0
+	}
+
+	for n := 1; n < MAXCLUSTERS; n++ {
+
+		recent[n] = make(map[string][]int)
+
+		for ngram,occurrences := range fs.ltm[n] {
+
+			for _,o := range occurrences {
+				recent[n][ngram] = append(recent[n][ngram],o - base)
+			}
+		}
+	}
+
+	return LongitudinalPersistentConcepts(FractionatorRankNgrams(fs.F,fs.sentences - base,recent))
+}
+
+// ****************************************************************************
+
+func StreamText(fs *FractionStream, text string, emit func(PrismLeg,[]PrismEvent)) {
+
+	// Add raw text that ends on a sentence boundary, e.g. a chat message
+
+	for _,sentence := range SplitIntoSentences(FractionatorCleanText(fs.F,text)) {
+
+		if leg,events,done := StreamSentence(fs,sentence); done && emit != nil {
+			emit(leg,events)
+		}
+	}
+}
+
+// ****************************************************************************
+
+func StreamReader(fs *FractionStream, r io.Reader, emit func(PrismLeg,[]PrismEvent)) error {
+
+	// Read raw text until EOF, sentence by sentence, then flush the last leg
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte,4096),STREAM_MAX_SENTENCE)
+	scanner.Split(ScanSentencesFor(fs.F))
+
+	for scanner.Scan() {
+		StreamText(fs,scanner.Text(),emit)
+	}
+
+	if leg,events,done := StreamFlush(fs); done && emit != nil {
+		emit(leg,events)
+	}
+
+	return scanner.Err()
+}
+
+// ****************************************************************************
+
+func ScanSentences(data []byte, atEOF bool) (int,[]byte,error) {
+
+	// A bufio.SplitFunc ending sentences at every . ! or ?, or at a
+	// newline (as in chat and logs)
+
+	return ScanSentence(data,atEOF,PunctuationSegmenter{},nil)
+}
+
+// ****************************************************************************
+
+func ScanSentencesFor(f *Fractionator) bufio.SplitFunc {
+
+	// As ScanSentences, where the fractionator's segmenter says a sentence
+	// ends, with its language pack (which may only be detected later)
+
+	return func(data []byte, atEOF bool) (int,[]byte,error) {
+		return ScanSentence(data,atEOF,FractionatorSegmenter(f),f.Pack)
+	}
+}
+
+// ****************************************************************************
+
+func ScanSentence(data []byte, atEOF bool, seg Segmenter, pack *LanguagePack) (int,[]byte,error) {
+
+	// Find the end of the first sentence in raw text: a newline, or a run of
+	// terminators that the segmenter accepts, given what follows the run.
+	// Over-long runs are cut, so that memory stays bounded
+
+	for i := 0; i < len(data); {
+
+		r, size := utf8.DecodeRune(data[i:])
+
+		if r == '\n' {
+			return i + size, data[:i+size], nil
+		}
+
+		if _,ok := TerminatorMark(r,pack); !ok {
+			i += size
+			continue
+		}
+
+		// The whole run of terminators, then the first character after spaces
+
+		j := i + size
+
+		for j < len(data) {
+
+			r, size := utf8.DecodeRune(data[j:])
+
+			if _,ok := TerminatorMark(r,pack); !ok {
+				break
+			}
+
+			j += size
+		}
+
+		k := j
+
+		for k < len(data) && (data[k] == ' ' || data[k] == '\t') {
+			k++
+		}
+
+		if (k == len(data) || !utf8.FullRune(data[k:])) && !atEOF {
+			return 0, nil, nil  // need to see what follows
+		}
+
+		if k < len(data) {
+			_, size := utf8.DecodeRune(data[k:])
+			k += size
+		}
+
+		// Ask the segmenter about the run as it will be after cleaning
+
+		var mark string
+
+		for _,t := range string(data[i:j]) {
+			m,_ := TerminatorMark(t,pack)
+			mark += m
+		}
+
+		text := string(data[:i]) + mark + string(data[j:k])
+
+		if seg.EndsSentence(text,i,i+len(mark),pack) {
+			return j, data[:j], nil
+		}
+
+		i = j
+	}
+
+	if len(data) >= STREAM_MAX_SENTENCE - utf8.UTFMax {
+
+		cut := len(data)
+
+		if !utf8.FullRune(data[RuneStartBefore(data,cut):]) {
+			cut = RuneStartBefore(data,cut)
+		}
+
+		return cut, data[:cut], nil
+	}
+
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// ****************************************************************************
+
+func RuneStartBefore(data []byte, end int) int {
+
+	// The start of the last rune before end, which may be incomplete
+
+	i := end - 1
+
+	for i > 0 && !utf8.RuneStart(data[i]) {
+		i--
+	}
+
+	return i
+}
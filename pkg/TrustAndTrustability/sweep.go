@@ -0,0 +1,281 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Parameter sweeps - the text prism over a corpus for a grid of configs
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ****************************************************************************
+// To see how the selection depends on the tuning parameters, run the prism
+// over the same corpus for every point of a grid, e.g.
+//
+//   grid, err := TT.ParseSweepGrid("leg_window=10,50,100 intent_cutoff=0.1,0.3,1")
+//   grid, err := TT.ParseSweepGrid("auto_leg_window=0,1 min_recurrence=1,3,10")
+//   configs, err := TT.SweepConfigs(TT.DefaultFractionationConfig(),grid)
+//   results := TT.SweepTextPrism(texts,configs)
+//   TT.WriteSweepResults("sweep.dat",results)
+//
+// Zero is a value on a grid (e.g. intent_cutoff=0), not the default, and
+// forget is not an axis, as it only applies to streams.
+//
+// Each config gets a fresh fractionator, which learns across the corpus in
+// the order given, as one fractionator would. With auto_leg_window=1 the
+// results report the average leg window chosen for the documents.
+// ****************************************************************************
+
+type SweepResult struct {
+
+	Config       FractionationConfig `json:"config"`
+	Documents    int                 `json:"documents"`
+	Sentences    int                 `json:"sentences"`
+	Words        int                 `json:"words"`
+	LegWindow    float64             `json:"leg_window"`      // average over documents, as chosen with auto_leg_window
+	Legs         int                 `json:"legs"`
+	Kept         int                 `json:"kept"`            // events selected
+	Efficiency   float64             `json:"efficiency"`      // kept / sentences
+	EventsPerLeg float64             `json:"events_per_leg"`
+	Topics       int                 `json:"topics"`          // intentional n-grams, all lengths
+	TopicIntent  float64             `json:"topic_intent"`    // their average intent
+}
+
+// ****************************************************************************
+
+func SetFractionationParam(config *FractionationConfig, name string, value float64) error {
+
+	// Set a numerical parameter by its JSON name. A tuning parameter set
+	// to zero this way stays zero, rather than meaning the default
+
+	switch name {
+
+	case "leg_window":
+		if value != float64(int(value)) || value < 1 {
+			return fmt.Errorf("leg_window should be a whole number of sentences, not %v",value)
+		}
+		config.LegWindow = int(value)
+
+	case "auto_leg_window":
+		if value != 0 && value != 1 {
+			return fmt.Errorf("auto_leg_window should be 0 or 1, not %v",value)
+		}
+		config.AutoLegWindow = value == 1
+
+	case "meaning_threshold":
+		config.MeaningThreshold = value
+	case "intent_cutoff":
+		config.IntentCutoff = value
+	case "minimum_frequency":
+		config.MinimumFrequency = value
+	case "minimum_work":
+		config.MinimumWork = value
+	case "forget":
+		config.Forget = value
+	case "min_recurrence":
+		config.MinRecurrence = value
+	case "max_recurrence":
+		config.MaxRecurrence = value
+
+	default:
+		return fmt.Errorf("no fractionation parameter \"%s\"",name)
+	}
+
+	config.explicit |= FractionationParamBit(name)
+
+	return nil
+}
+
+// ****************************************************************************
+
+func ParseSweepGrid(s string) (map[string][]float64,error) {
+
+	// "name=v1,v2,... name=..." separated by spaces or semicolons
+
+	grid := make(map[string][]float64)
+
+	for _,axis := range strings.FieldsFunc(s,func(r rune) bool { return r == ' ' || r == ';' }) {
+
+		name, values, ok := strings.Cut(axis,"=")
+
+		if !ok || name == "" {
+			return nil, fmt.Errorf("sweep axis \"%s\" should be name=v1,v2,...",axis)
+		}
+
+		for _,v := range strings.Split(values,",") {
+
+			value, err := strconv.ParseFloat(strings.TrimSpace(v),64)
+
+			if err != nil {
+				return nil, fmt.Errorf("sweep axis %s: %v",name,err)
+			}
+
+			grid[name] = append(grid[name],value)
+		}
+	}
+
+	return grid, nil
+}
+
+// ****************************************************************************
+
+func SweepConfigs(base FractionationConfig, grid map[string][]float64) ([]FractionationConfig,error) {
+
+	// Every combination of the grid's values, on top of the base config.
+	// Combinations that don't pass CheckFractionationConfig are errors
+
+	var names []string
+
+	for name := range grid {
+
+		// Batch prisms never forget, so it would only relabel the same results
+
+		if name == "forget" {
+			return nil, fmt.Errorf("forget only applies to streams, it can't be swept with the text prism")
+		}
+
+		names = append(names,name)
+	}
+
+	sort.Strings(names)
+
+	configs := []FractionationConfig{ base }
+
+	for _,name := range names {
+
+		var next []FractionationConfig
+
+		for _,c := range configs {
+
+			for _,value := range grid[name] {
+
+				if err := SetFractionationParam(&c,name,value); err != nil {
+					return nil, err
+				}
+
+				next = append(next,c)
+			}
+		}
+
+		configs = next
+	}
+
+	for i := range configs {
+
+		checked, err := CheckFractionationConfig(configs[i])
+
+		if err != nil {
+			return nil, err
+		}
+
+		configs[i] = checked
+	}
+
+	return configs, nil
+}
+
+// ****************************************************************************
+
+func SweepTextPrism(texts []string, configs []FractionationConfig) []SweepResult {
+
+	// Raw texts, cleaned for each config, since its language and segmenter
+	// decide where sentences end
+
+	var results []SweepResult
+
+	for _,config := range configs {
+
+		f := NewFractionator(config)
+		r := SweepResult{ Config: f.Config, Documents: len(texts) }
+
+		var intent float64
+
+		for i,text := range texts {
+
+			prism := FractionatorTextPrism(f,fmt.Sprintf("sweep_%d",i),FractionatorCleanText(f,text))
+
+			r.LegWindow += float64(prism.Config.LegWindow)
+			r.Sentences += prism.Sentences
+			r.Words += prism.Words
+			r.Legs += len(prism.Legs)
+			r.Kept += prism.Kept
+
+			for _,ngrams := range prism.Intentional {
+				for _,ngram := range ngrams {
+					r.Topics++
+					intent += ngram.Intent
+				}
+			}
+		}
+
+		if len(texts) > 0 {
+			r.LegWindow /= float64(len(texts))
+		}
+
+		if r.Sentences > 0 {
+			r.Efficiency = float64(r.Kept) / float64(r.Sentences)
+		}
+
+		if r.Legs > 0 {
+			r.EventsPerLeg = float64(r.Kept) / float64(r.Legs)
+		}
+
+		if r.Topics > 0 {
+			r.TopicIntent = intent / float64(r.Topics)
+		}
+
+		results = append(results,r)
+	}
+
+	return results
+}
+
+// ****************************************************************************
+
+func WriteSweepResults(filename string, results []SweepResult) error {
+
+	// Plain columns for gnuplot, one line per config
+
+	var table strings.Builder
+
+	fmt.Fprintf(&table,"# leg_window auto_leg_window meaning_threshold intent_cutoff minimum_frequency minimum_work forget min_recurrence max_recurrence")
+	fmt.Fprintf(&table," documents sentences words legs kept efficiency events_per_leg topics topic_intent\n")
+
+	for _,r := range results {
+
+		c := r.Config
+
+		auto := 0
+
+		if c.AutoLegWindow {
+			auto = 1
+		}
+
+		fmt.Fprintf(&table,"%g %d %g %g %g %g %g %g %g",r.LegWindow,auto,c.MeaningThreshold,c.IntentCutoff,c.MinimumFrequency,c.MinimumWork,c.Forget,c.MinRecurrence,c.MaxRecurrence)
+		fmt.Fprintf(&table," %d %d %d %d %d %f %f %d %f\n",r.Documents,r.Sentences,r.Words,r.Legs,r.Kept,r.Efficiency,r.EventsPerLeg,r.Topics,r.TopicIntent)
+	}
+
+	return os.WriteFile(filename,[]byte(table.String()),0644)
+}
@@ -0,0 +1,303 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Text normalization and tokenization, for any script
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ****************************************************************************
+// Cleaning keeps what can be part of an n-gram - letters, combining marks and
+// digits in any script - and reduces punctuation to a few classes that the
+// fractionator understands:
+//
+//   sentence terminators (. ! ? 。 ！ ？ ؟ । ...)  ->  .  !  ?
+//   clause breaks        (; : ； ： ، ؛ ...)        ->  .     (as before)
+//   commas               (, ， 、 ...)              ->  ,
+//   brackets             (all opening/closing)      ->  (  )
+//   dashes               (– — ...)                  ->  ,     (hyphens are kept)
+//
+// Quotes, other punctuation and symbols are dropped. The text is first put in
+// NFC form, so that "é" is one rune however it was typed.
+//
+// Tokenizers then break a clause into the units that n-grams are made of:
+// words separated by whitespace, or single characters for scripts written
+// without spaces (Chinese, Japanese), e.g.
+//
+//   f := TT.NewFractionator(TT.FractionationConfig{ LegWindow: 10, Tokenizer: TT.TOKENIZER_CJK })
+// ****************************************************************************
+
+const TOKENIZER_WORDS = "words"
+const TOKENIZER_CJK = "cjk"
+
+// ****************************************************************************
+
+var SENTENCE_TERMINATORS = map[rune]string{
+
+	'.': ".", '!': "!", '?': "?",
+	'…': "...", '‼': "!", '⁇': "?", '⁈': "?", '⁉': "?",
+	'。': ".", '．': ".", '｡': ".", '！': "!", '？': "?",  // CJK, fullwidth and halfwidth
+	'؟': "?", '۔': ".",                                  // Arabic, Urdu
+	'।': ".", '॥': ".",                                  // Devanagari danda
+	'։': ".",                                            // Armenian
+	'።': ".", '፧': "?",                                  // Ethiopic
+	'။': ".",                                            // Myanmar
+	'។': ".",                                            // Khmer
+}
+
+var CLAUSE_BREAKS = map[rune]string{
+
+	';': ".", ':': ".", '；': ".", '：': ".", '؛': ".", '፤': ".", '፥': ".",
+	',': ",", '，': ",", '、': ",", '､': ",", '،': ",", '፣': ",", '‚': ",",
+}
+
+// ****************************************************************************
+
+func NormalizeText(content string) string {
+
+	return NormalizeTextFor(content,nil)
+}
+
+// ****************************************************************************
+
+func NormalizeTextFor(content string, pack *LanguagePack) string {
+
+	// Strip markup, then keep letters, marks and digits of any script, with
+	// punctuation reduced to the classes above, and the language pack's own
+	// terminators. Lines that end without punctuation (headings, list
+	// items) end with a clause break
+
+	// Start by stripping HTML / XML tags before para-split
+	// if they haven't been removed already
+
+	m1 := regexp.MustCompile("<[^>]*>")
+	stripped1 := m1.ReplaceAllString(content,"")
+
+	//Strip and \begin \latex type commands
+
+	m2 := regexp.MustCompile("\\\\[^ –\n]+")
+	stripped2 := m2.ReplaceAllString(stripped1," ")
+
+	var b strings.Builder
+	var last rune = ' '  // last non-space rune written
+
+	emit := func(s string) {
+		b.WriteString(s)
+		if s != " " {
+			last = []rune(s)[len([]rune(s))-1]
+		}
+	}
+
+	for _,r := range norm.NFC.String(stripped2) {
+
+		if mark, ok := TerminatorMark(r,pack); ok {
+			emit(mark)
+			continue
+		}
+
+		if mark, ok := CLAUSE_BREAKS[r]; ok {
+			emit(mark)
+			continue
+		}
+
+		switch {
+
+		case r == '\n':
+
+			if !strings.ContainsRune(" .,:!?",last) {
+				emit(":")
+			}
+
+			emit(" ")
+
+		case unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r):
+			emit(string(r))
+
+		case r == '-':
+			emit("-")
+
+		case unicode.Is(unicode.Pd,r):
+			emit(",")
+
+		case unicode.Is(unicode.Ps,r):
+			emit("(")
+
+		case unicode.Is(unicode.Pe,r):
+			emit(")")
+
+		case unicode.IsSpace(r):
+			emit(" ")
+
+		default:
+			// quotes, other punctuation, symbols and controls
+		}
+	}
+
+	return b.String()
+}
+
+// ****************************************************************************
+
+func TerminatorMark(r rune, pack *LanguagePack) (string,bool) {
+
+	// The . ! or ? that a sentence terminator becomes after cleaning
+
+	if pack != nil {
+		if mark, ok := pack.terminators[r]; ok {
+			return mark, true
+		}
+	}
+
+	mark, ok := SENTENCE_TERMINATORS[r]
+
+	return mark, ok
+}
+
+// ****************************************************************************
+
+type Tokenizer interface {
+
+	// Break a clause (text without sentence or clause punctuation) into
+	// lower case n-gram units
+
+	Tokens(clause string) []string
+}
+
+// ****************************************************************************
+
+var TOKENIZERS = map[string]Tokenizer{
+
+	TOKENIZER_WORDS: WordTokenizer{},
+	TOKENIZER_CJK:   CJKTokenizer{},
+}
+
+// ****************************************************************************
+
+func RegisterTokenizer(name string, t Tokenizer) {
+
+	TOKENIZERS[name] = t
+}
+
+// ****************************************************************************
+
+func TokenizerNamed(name string) Tokenizer {
+
+	if t, ok := TOKENIZERS[name]; ok {
+		return t
+	}
+
+	return WordTokenizer{}
+}
+
+// ****************************************************************************
+
+type WordTokenizer struct{}
+
+var WORD_JUNK = strings.NewReplacer("/","","(","",")","","?","","!","")
+
+// ****************************************************************************
+
+func (WordTokenizer) Tokens(clause string) []string {
+
+	// Words separated by whitespace. Numbers on their own are not words
+
+	var tokens []string
+
+	for _,word := range strings.Fields(clause) {
+
+		word = strings.ToLower(WORD_JUNK.Replace(word))
+
+		if HasLetter(word) {
+			tokens = append(tokens,word)
+		}
+	}
+
+	return tokens
+}
+
+// ****************************************************************************
+
+type CJKTokenizer struct{}
+
+// ****************************************************************************
+
+func (CJKTokenizer) Tokens(clause string) []string {
+
+	// Each Han, Hiragana or Katakana character is a unit, since these
+	// scripts have no spaces. Runs of other letters, e.g. Latin names
+	// within Chinese text, are words as usual
+
+	var tokens []string
+	var word []rune
+
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens,WordTokenizer{}.Tokens(string(word))...)
+			word = word[:0]
+		}
+	}
+
+	for _,r := range clause {
+
+		if IsCJK(r) {
+			flush()
+			tokens = append(tokens,string(r))
+			continue
+		}
+
+		if unicode.IsSpace(r) {
+			flush()
+			continue
+		}
+
+		word = append(word,r)
+	}
+
+	flush()
+
+	return tokens
+}
+
+// ****************************************************************************
+
+func IsCJK(r rune) bool {
+
+	return unicode.In(r,unicode.Han,unicode.Hiragana,unicode.Katakana,unicode.Bopomofo)
+}
+
+// ****************************************************************************
+
+func HasLetter(s string) bool {
+
+	for _,r := range s {
+		if unicode.IsLetter(r) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,228 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Time and calendar hard classes, CFEngine style
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ****************************************************************************
+// The parts of DoughNowt, defined as classes in a context store, so that
+// expressions like "Monday.Morning & !holiday" can be used in policy, e.g.
+//
+//   Yr2023 January Day19 Monday Hr13 Min05 Q1 Hr13_Q1 Afternoon Min05_10
+//   Lcycle_1 tz_cet holiday christmas
+//
+// and the same (except holidays) prefixed GMT_ for UTC. Holidays are read
+// from a JSON list, e.g.
+//
+//   [ { "class": "christmas", "date": "12-24", "days": 3 },
+//     { "class": "easter", "date": "2024-03-29", "days": 4 } ]
+//
+// where a date without a year recurs every year.
+// ****************************************************************************
+
+const HOLIDAY_CLASS = "holiday"
+
+// ****************************************************************************
+
+type Holiday struct {
+
+	Class string `json:"class"`
+	Date  string `json:"date"`  // "2006-01-02", or "01-02" for every year
+	Days  int    `json:"days"`  // length, from Date, default 1
+}
+
+// ****************************************************************************
+
+var TIMEZONE *time.Location = time.Local
+var HOLIDAYS []Holiday
+
+// ****************************************************************************
+
+func TimeContext(then time.Time) []string {
+
+	// Define the time classes in TT.CONTEXT, in TT.TIMEZONE with TT.HOLIDAYS
+
+	return DefineTimeClasses(CONTEXT,then,TIMEZONE,HOLIDAYS)
+}
+
+// ****************************************************************************
+
+func DefineTimeClasses(cs *ContextStore, then time.Time, loc *time.Location, holidays []Holiday) []string {
+
+	// Time classes replace the ones defined last time, as time moves on
+
+	classes := TimeClasses(then,loc,holidays)
+	now := then.UnixNano()
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	for _,class := range cs.timed {
+		delete(cs.classes,class)
+	}
+
+	for _,class := range classes {
+		cs.classes[class] = ContextClass{ Value: 1, First: now, Last: now }
+	}
+
+	cs.timed = classes
+
+	return classes
+}
+
+// ****************************************************************************
+
+func TimeClasses(then time.Time, loc *time.Location, holidays []Holiday) []string {
+
+	if loc != nil {
+		then = then.In(loc)
+	}
+
+	var classes []string
+
+	zone,_ := then.Zone()
+
+	classes = append(classes,TimePartClasses(DoughNowtParts(then),"")...)
+	classes = append(classes,fmt.Sprintf("Lcycle_%d",then.Year() % 3))
+	classes = append(classes,"tz_" + ClassName(zone))
+	classes = append(classes,TimePartClasses(DoughNowtParts(then.UTC()),"GMT_")...)
+	classes = append(classes,HolidayClasses(then,holidays)...)
+
+	return classes
+}
+
+// ****************************************************************************
+
+func TimePartClasses(t TimeParts, prefix string) []string {
+
+	parts := []string{ t.Year, t.Month, t.Day, t.Weekday, t.Hour, t.Mins, t.Quarter, t.Hour + "_" + t.Quarter, t.Shift, t.Interval }
+
+	for i := range parts {
+		parts[i] = prefix + parts[i]
+	}
+
+	return parts
+}
+
+// ****************************************************************************
+
+func HolidayClasses(then time.Time, holidays []Holiday) []string {
+
+	// Holidays are whole days in the local calendar of then
+
+	var classes []string
+
+	today := time.Date(then.Year(),then.Month(),then.Day(),0,0,0,0,time.UTC)
+
+	for _,h := range holidays {
+
+		if OnHoliday(today,h) {
+
+			if len(classes) == 0 {
+				classes = append(classes,HOLIDAY_CLASS)
+			}
+
+			classes = append(classes,ClassName(h.Class))
+		}
+	}
+
+	return classes
+}
+
+// ****************************************************************************
+
+func OnHoliday(today time.Time, h Holiday) bool {
+
+	days := h.Days
+
+	if days < 1 {
+		days = 1
+	}
+
+	var starts []time.Time
+
+	if start, err := time.Parse("2006-01-02",h.Date); err == nil {
+
+		starts = append(starts,start)
+
+	} else if start, err := time.Parse("01-02",h.Date); err == nil {
+
+		// Recurring, so it may have begun last year
+
+		for _,year := range []int{ today.Year()-1, today.Year() } {
+			starts = append(starts,time.Date(year,start.Month(),start.Day(),0,0,0,0,time.UTC))
+		}
+	}
+
+	for _,start := range starts {
+
+		elapsed := today.Sub(start).Hours() / 24
+
+		if elapsed >= 0 && elapsed < float64(days) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ****************************************************************************
+
+func LoadHolidays(filename string) ([]Holiday,error) {
+
+	// Read a JSON holiday list and make it current
+
+	var holidays []Holiday
+
+	content, err := os.ReadFile(filename)
+
+	if err != nil {
+		return HOLIDAYS, err
+	}
+
+	if err = json.Unmarshal(content,&holidays); err != nil {
+		return HOLIDAYS, fmt.Errorf("holidays %s: %v",filename,err)
+	}
+
+	for i,h := range holidays {
+
+		if h.Class == "" {
+			return HOLIDAYS, fmt.Errorf("holidays %s: entry %d has no class",filename,i)
+		}
+
+		_, err1 := time.Parse("2006-01-02",h.Date)
+		_, err2 := time.Parse("01-02",h.Date)
+
+		if err1 != nil && err2 != nil {
+			return HOLIDAYS, fmt.Errorf("holidays %s: %s: bad date \"%s\", expecting YYYY-MM-DD or MM-DD",filename,h.Class,h.Date)
+		}
+	}
+
+	HOLIDAYS = holidays
+	return holidays, nil
+}
@@ -0,0 +1,167 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Trust decay - evidence about promise keeping goes stale when unobserved
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"math"
+)
+
+// ****************************************************************************
+// Relaxation of reliability toward a prior
+// ****************************************************************************
+
+type DecayPolicy struct {
+
+	Prior      float64  `json:"prior"`       // reliability assumed in the absence of evidence
+	HalfLife   float64  `json:"half_life"`   // relaxation half-life, in average sampling intervals
+	StaleAfter float64  `json:"stale_after"` // unobserved sampling intervals before evidence is stale
+	Bootstrap  float64  `json:"bootstrap"`   // assumed sampling interval (s) before Dt_av is learned
+
+	set        map[string]bool  // fields present in the JSON, as for PromisePolicy
+}
+
+// The default prior is "start evens", as in AssessPromiseOutcome
+
+var TRUST_DECAY = DecayPolicy{ Prior: 0.5, HalfLife: 10, StaleAfter: 3, Bootstrap: 300 }
+
+const TRUST_BASIS_OBSERVED = "recently_verified"
+const TRUST_BASIS_STALE = "stale_evidence"
+const TRUST_BASIS_DEFAULT = "default_prior"
+
+// ****************************************************************************
+
+type TrustStatus struct {
+
+	PromiseId   string
+	Reliability float64  // decayed estimate at the time of the query
+	Assessed    float64  // value as last assessed, without decay
+	Prior       float64
+
+	Age         float64  // seconds since the last observation
+	Intervals   float64  // age in units of the average sampling interval
+	Stale       bool
+	Basis       string   // one of TRUST_BASIS_*
+}
+
+// ****************************************************************************
+
+func SamplingInterval(e PromiseHistory, policy DecayPolicy) float64 {
+
+	// The natural clock of a promise is its own average sampling interval,
+	// so staleness is relative to how often we usually see it (in ns)
+
+	if e.Dt_av > 0 {
+		return e.Dt_av
+	}
+
+	return policy.Bootstrap * NANO
+}
+
+// ****************************************************************************
+
+func UnobservedInterval(e PromiseHistory, policy DecayPolicy) float64 {
+
+	// The time since the previous sample beyond the usual sampling interval
+	// (in ns). Regular sampling leaves nothing unobserved, else every
+	// assessment would pull the reliability toward the prior
+
+	if e.T1 == NOT_EXIST {
+		return 0
+	}
+
+	return math.Max(0,float64(e.T-e.T1) - SamplingInterval(e,policy))
+}
+
+// ****************************************************************************
+
+func RelaxReliability(reliability float64, elapsed_ns float64, e PromiseHistory, policy DecayPolicy) float64 {
+
+	// Exponential relaxation toward the prior, measured in sampling intervals
+	// rather than wall clock time: a promise sampled hourly doesn't go stale
+	// in minutes, but one sampled every second does
+
+	if elapsed_ns <= 0 || policy.HalfLife <= 0 {
+		return reliability
+	}
+
+	intervals := elapsed_ns / SamplingInterval(e,policy)
+	weight := math.Exp(-math.Ln2 * intervals / policy.HalfLife)
+
+	return policy.Prior + (reliability - policy.Prior) * weight
+}
+
+// ****************************************************************************
+
+func AssessTrustStatus(reliability float64, e PromiseHistory, now int64, policy DecayPolicy) TrustStatus {
+
+	// Distinguish "trusted because recently verified" from "trusted by default"
+
+	var status TrustStatus
+
+	status.PromiseId = e.PromiseId
+	status.Prior = policy.Prior
+	status.Assessed = reliability
+
+	if reliability == 0 || e.T == NOT_EXIST {
+
+		status.Reliability = policy.Prior
+		status.Stale = true
+		status.Basis = TRUST_BASIS_DEFAULT
+		return status
+	}
+
+	elapsed := float64(now - e.T)
+
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	status.Age = elapsed / NANO
+	status.Intervals = elapsed / SamplingInterval(e,policy)
+	status.Reliability = RelaxReliability(reliability,elapsed,e,policy)
+
+	if status.Intervals > policy.StaleAfter {
+		status.Stale = true
+		status.Basis = TRUST_BASIS_STALE
+	} else {
+		status.Basis = TRUST_BASIS_OBSERVED
+	}
+
+	return status
+}
+
+// ****************************************************************************
+
+func GetTrustStatus(g Analytics, coll_name, key string, now int64) TrustStatus {
+
+	// Query the current reliability of a promise, as stored by AssessPromiseOutcome
+	// in PromiseKeeping, aged by the time since its history in coll_name was updated
+	// now should be time.Now().UnixNano()
+
+	reliability := GetKV(g,"PromiseKeeping",key)
+	_,e,_ := GetPromiseHistory(g,coll_name,key)
+
+	e.PromiseId = key
+
+	return AssessTrustStatus(reliability.V,e,now,PolicyDecay(GetPromisePolicy(key)))
+}
@@ -0,0 +1,221 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Work measures - the effort it takes to write an n-gram
+//*
+// ***************************************************************************
+
+package TT
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// ****************************************************************************
+// Intentionality grows with the work an author puts into a phrase. For
+// alphabetic text the length in characters is a fair measure, but a Chinese
+// character of one rune may take twenty brush strokes, so there the number
+// of strokes is used instead, as in the Chinese n-gram example, e.g.
+//
+//   TT.LoadStrokes("chinese-strokes.in")
+//   f := TT.NewFractionator(TT.FractionationConfig{ LegWindow: 10, Language: "zh" })
+//
+// The zh language pack chooses WORK_STROKES; a fractionator's config can
+// choose another, or a registered measure.
+// ****************************************************************************
+
+const WORK_LENGTH = "length"
+const WORK_STROKES = "strokes"
+
+const AVERAGE_STROKES = 10  // for Han characters missing from the stroke table
+
+// ****************************************************************************
+
+type WorkMeasure func(ngram string) float64
+
+var WORK_MEASURES = map[string]WorkMeasure{
+
+	WORK_LENGTH:  LengthWork,
+	WORK_STROKES: StrokeWork,
+}
+
+// Brush strokes per Han character, see LoadStrokes
+
+var STROKES = make(map[rune]int)
+
+// ****************************************************************************
+
+func RegisterWorkMeasure(name string, w WorkMeasure) {
+
+	WORK_MEASURES[name] = w
+}
+
+// ****************************************************************************
+
+func WorkMeasureNamed(name string) WorkMeasure {
+
+	if w, ok := WORK_MEASURES[name]; ok {
+		return w
+	}
+
+	return LengthWork
+}
+
+// ****************************************************************************
+
+func LengthWork(ngram string) float64 {
+
+	// Characters, including the spaces between words
+
+	return float64(len([]rune(ngram)))
+}
+
+// ****************************************************************************
+
+func StrokeWork(ngram string) float64 {
+
+	// Half the brush strokes of Han characters (as in ngrams-chinese.go),
+	// and one per character of any other script. Spaces don't count
+
+	var work float64
+
+	for _,r := range ngram {
+
+		switch {
+
+		case unicode.Is(unicode.Han,r):
+
+			if strokes, ok := STROKES[r]; ok {
+				work += float64(strokes) / 2
+			} else {
+				work += AVERAGE_STROKES / 2
+			}
+
+		case unicode.IsSpace(r):
+
+		default:
+			work++
+		}
+	}
+
+	return work
+}
+
+// ****************************************************************************
+
+func LoadStrokes(filename string) (int,error) {
+
+	// Read a table of lines "character frequency strokes", such as
+	// src/chinese-strokes.in, into STROKES
+
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	var count int
+
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+
+		var ch rune
+		var frequency, strokes int
+
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" {
+			continue
+		}
+
+		if _, err := fmt.Sscanf(text,"%c %d %d",&ch,&frequency,&strokes); err != nil || strokes < 1 {
+			return count, fmt.Errorf("%s line %d: expected \"character frequency strokes\"",filename,line)
+		}
+
+		STROKES[ch] = strokes
+		count++
+	}
+
+	return count, scanner.Err()
+}
+
+// ****************************************************************************
+
+func NgramKey(tokens []string) string {
+
+	// Words are joined by spaces, but characters of scripts written
+	// without spaces are joined as they are written
+
+	var key string
+
+	for j := range tokens {
+
+		if j > 0 && !(IsCJKToken(tokens[j-1]) && IsCJKToken(tokens[j])) {
+			key = key + " "
+		}
+
+		key = key + tokens[j]
+	}
+
+	return key
+}
+
+// ****************************************************************************
+
+func NgramLength(key string) int {
+
+	// The number of tokens NgramKey joined, counting each character of a
+	// run without spaces, e.g. "中国人" is 3, "trust 中国" is 3
+
+	var n int
+
+	for _,word := range strings.Split(key," ") {
+
+		cjk := 0
+
+		for _,r := range word {
+			if IsCJK(r) {
+				cjk++
+			}
+		}
+
+		if cjk > 0 && cjk == len([]rune(word)) {
+			n += cjk
+		} else {
+			n++
+		}
+	}
+
+	return n
+}
+
+// ****************************************************************************
+
+func IsCJKToken(token string) bool {
+
+	r := []rune(token)
+
+	return len(r) == 1 && IsCJK(r[0])
+}
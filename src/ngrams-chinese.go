@@ -18,7 +18,10 @@
 //  go run ngrams-chinese.go ../../chinese2.dat 20 
 
 
-// This UTF8 example is only a PoC, not integrated into the main project yet
+// This UTF8 example was the PoC, kept for its history. The same analysis is now
+// in the TT library (the zh language pack: character n-grams, work by strokes), e.g.
+//
+//  go run textstream.go -language zh -strokes chinese-strokes.in -leg 20 ../../chinese2.dat
 
 package main
 
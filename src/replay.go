@@ -0,0 +1,101 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Replay a log of promise events (promise,start,end,quality) through the
+// promise machinery, as if they were happening now, e.g.
+//
+//     go run replay.go -reset -weekly replay_weekly events.csv
+//     go run replay.go events.jsonl
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"TT"
+)
+
+const (
+	POLICYFILE = "promise_policy.json"
+)
+
+// ****************************************************************************
+
+func main() {
+
+	reset := flag.Bool("reset",false,"truncate promise histories before replaying, for a clean rebuild")
+	weekly := flag.String("weekly","","also learn latencies into this weekly KV collection")
+	policyfile := flag.String("policy",POLICYFILE,"promise policy file")
+
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	events, err := TT.ReadReplayLog(args[0])
+
+	if err != nil {
+		fmt.Println("Couldn't read event log:",err)
+		os.Exit(1)
+	}
+
+	var dbname string = "SemanticSpacetime"
+	var url string = "http://localhost:8529"
+	var user string = "root"
+	var pwd string = "mark"
+
+	g := TT.OpenAnalytics(dbname,url,user,pwd)
+
+	_,err = TT.LoadPromisePolicy(*policyfile)
+
+	if err != nil {
+		fmt.Println("Using default promise policy:",err)
+	}
+
+	opts := TT.ReplayOptions{ Reset: *reset, Weekly: *weekly }
+
+	summary := TT.ReplayPromiseLog(g,events,opts)
+
+	fmt.Println("Replayed",summary.Events,"events from",summary.First,"to",summary.Last)
+
+	var names []string
+
+	for name := range summary.Reliability {
+		names = append(names,name)
+	}
+
+	sort.Strings(names)
+
+	for _,name := range names {
+		fmt.Printf(" %-30s reliability %.4f\n",name,summary.Reliability[name])
+	}
+}
+
+// ****************************************************************************
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "usage: go run replay.go [-reset] [-weekly collection] [-policy file] <events.csv|events.jsonl>\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
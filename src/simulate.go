@@ -0,0 +1,109 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Simulate agents keeping and breaking promises, and see how well the trust
+// assessment tracks what they really do. No database is needed, e.g.
+//
+//     go run simulate.go -seed 1 -out ../data/Simulation
+//     go run simulate.go -config agents.json
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"TT"
+)
+
+const (
+	POLICYFILE = "promise_policy.json"
+)
+
+// ****************************************************************************
+
+func main() {
+
+	seed := flag.Int64("seed",0,"random seed (0 = from config)")
+	steps := flag.Int("steps",0,"number of steps (0 = from config)")
+	configfile := flag.String("config","","JSON simulation config (default population if none)")
+	policyfile := flag.String("policy",POLICYFILE,"promise policy file")
+	outdir := flag.String("out","simulation","directory for results")
+	diagnostics := flag.Bool("diagnostics",false,"print the trust assessment's commentary for every step")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	config := TT.DefaultSimulation()
+
+	if *configfile != "" {
+
+		var err error
+
+		config, err = TT.LoadSimulationConfig(*configfile)
+
+		if err != nil {
+			fmt.Println("Couldn't read simulation config:",err)
+			os.Exit(1)
+		}
+	}
+
+	if *seed != 0 {
+		config.Seed = *seed
+	}
+
+	if *steps != 0 {
+		config.Steps = *steps
+	}
+
+	if *diagnostics {
+		config.Diagnostics = true
+	}
+
+	_,err := TT.LoadPromisePolicy(*policyfile)
+
+	if err != nil {
+		fmt.Println("Using default promise policy:",err)
+	}
+
+	result := TT.RunSimulation(config)
+
+	fmt.Printf("Seed %d, %d steps of %.0fs, tolerance %.2f\n\n",config.Seed,config.Steps,config.Interval,config.Tolerance)
+	fmt.Printf(" %-12s %8s %8s %8s %8s %8s\n","agent","MAE","RMSE","lag","missed","final")
+
+	for _,res := range result.Agents {
+		fmt.Printf(" %-12s %8.4f %8.4f %8.1f %8d %8.4f\n",res.Name,res.MAE,res.RMSE,res.MeanLag,res.Unsettled,res.FinalError)
+	}
+
+	err = TT.WriteSimulationResults(*outdir,result)
+
+	if err != nil {
+		fmt.Println("Couldn't write results:",err)
+		os.Exit(1)
+	}
+
+	fmt.Println("\nResults in",*outdir)
+}
+
+// ****************************************************************************
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "usage: go run simulate.go [-seed n] [-steps n] [-config file] [-policy file] [-out dir] [-diagnostics]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
@@ -0,0 +1,103 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Run the text prism over a corpus of files for a grid of tuning parameters,
+// and tabulate how much it selects for each. No database is needed, e.g.
+//
+//     go run sweep.go -grid "leg_window=10,50,100 intent_cutoff=0.1,0.3,1" ../data/*.txt
+//     go run sweep.go -grid "min_recurrence=1,3,10" -language auto -out sweep.dat book.txt
+//     go run sweep.go -grid "auto_leg_window=0,1" articles/*.txt histories/*.txt
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"TT"
+)
+
+// ****************************************************************************
+
+func main() {
+
+	grid := flag.String("grid","leg_window=10,50,100","parameters and their values, \"name=v1,v2 name=...\"")
+	language := flag.String("language","","language pack, e.g. en, zh, or auto to detect it")
+	segmenter := flag.String("segmenter","","punctuation, or rules (default: rules with a language)")
+	outfile := flag.String("out","sweep.dat","file for the results")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	axes, err := TT.ParseSweepGrid(*grid)
+
+	if err != nil {
+		fmt.Println("Bad grid:",err)
+		os.Exit(1)
+	}
+
+	base := TT.DefaultFractionationConfig()
+	base.Language = *language
+	base.Segmenter = *segmenter
+
+	configs, err := TT.SweepConfigs(base,axes)
+
+	if err != nil {
+		fmt.Println("Bad grid:",err)
+		os.Exit(1)
+	}
+
+	var texts []string
+
+	for _,filename := range flag.Args() {
+
+		content, err := os.ReadFile(filename)
+
+		if err != nil {
+			fmt.Println("Couldn't read corpus:",err)
+			os.Exit(1)
+		}
+
+		texts = append(texts,string(content))
+	}
+
+	results := TT.SweepTextPrism(texts,configs)
+
+	for _,r := range results {
+		fmt.Printf("leg %g cutoff %g recurrence %g..%g legs: %d sentences, %d legs, kept %d (%.3f), %.2f per leg, %d topics\n",
+			r.LegWindow,r.Config.IntentCutoff,r.Config.MinRecurrence,r.Config.MaxRecurrence,
+			r.Sentences,r.Legs,r.Kept,r.Efficiency,r.EventsPerLeg,r.Topics)
+	}
+
+	if err := TT.WriteSweepResults(*outfile,results); err != nil {
+		fmt.Println("Couldn't write results:",err)
+		os.Exit(1)
+	}
+}
+
+// ****************************************************************************
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "usage: go run sweep.go [-grid \"name=v1,v2 ...\"] [-language name|auto] [-segmenter name] [-out file] file ...\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
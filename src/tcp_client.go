@@ -35,6 +35,8 @@ const (
 	HOST = "localhost"
 	PORT = "8080"
 	TYPE = "tcp"
+
+	POLICYFILE = "promise_policy.json"
 )
 
 var LATENCY []TT.PromiseHistory
@@ -71,6 +73,14 @@ func main() {
 
 	g := TT.OpenAnalytics(dbname,url,user,pwd)
 
+	// SLO bounds, monitoring interval and anti-DoS limits are policy
+
+	_,err := TT.LoadPromisePolicy(POLICYFILE)
+
+	if err != nil {
+		fmt.Println("Using default promise policy:",err)
+	}
+
 	// Trusting DNS
 
 	tcpServer, err := net.ResolveTCPAddr(TYPE, HOST+":"+PORT)
@@ -118,12 +128,9 @@ func main() {
 
 	e := TT.PromiseContext_End(g,ctx)
 
-	// Do we know what was promised? Or how to express it? Our SLO?
-
-	promised_upper_bound := 1.6 // response time in seconds
-	trust_interval := 1.0       // monitor interval in seconds
+	// Do we know what was promised? Or how to express it? See POLICYFILE
 
-	V := TT.AssessPromiseOutcome(g,e,AssessResult(string(received)),promised_upper_bound, trust_interval)
+	V := TT.AssessPromiseByPolicy(g,e,AssessResult(string(received)))
 
 	s := fmt.Sprintf("/tmp/server_%v",remoteAddr)
 	TT.AppendFileValue(s,V)
@@ -36,6 +36,8 @@ const (
 	HOST = "localhost"
 	PORT = "8080"
 	TYPE = "tcp"
+
+	POLICYFILE = "promise_policy.json"
 )
 
 // ***************************************************************
@@ -60,6 +62,14 @@ func main() {
 
 	g := TT.OpenAnalytics(dbname,url,user,pwd)
 
+	// SLO bounds, monitoring interval and anti-DoS limits are policy
+
+	_,err = TT.LoadPromisePolicy(POLICYFILE)
+
+	if err != nil {
+		fmt.Println("Using default promise policy:",err)
+	}
+
 	// 
 
 	defer listen.Close()
@@ -126,12 +136,9 @@ func handleRequest(conn net.Conn, g TT.Analytics, count int) {
 
 	e := TT.PromiseContext_End(g,ctx)
 
-	// Do we know what was promised? Or how to express it?
-
-	promised_upper_bound := 1.6 // response time in seconds
-	trust_interval := 1.0       // monitor interval in seconds
+	// Do we know what was promised? Or how to express it? See POLICYFILE
 
-	V := TT.AssessPromiseOutcome(g,e,AssessResult(string(received)),promised_upper_bound,trust_interval)
+	V := TT.AssessPromiseByPolicy(g,e,AssessResult(string(received)))
 
 	// On the server side, the port is random so strip it off
 
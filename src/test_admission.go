@@ -0,0 +1,93 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Check that trust weighted admission follows the reliability stored for a
+// promise: store a history for a reliable and an unreliable promise, the way
+// PromiseContext_End and AssessPromiseOutcome do, then count how many of the
+// same burst of requests each one gets admitted. Needs the database, e.g.
+//
+//     go run test_admission.go
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"TT"
+)
+
+const REQUESTS = 100
+
+// ***********************************************************************
+
+func main() {
+
+	var dbname string = "SemanticSpacetime"
+	var url string = "http://localhost:8529"
+	var user string = "root"
+	var pwd string = "mark"
+
+	g := TT.OpenAnalytics(dbname,url,user,pwd)
+
+	policy := TT.AdmissionPolicy{ Kind: TT.ADMISSION_SLIDING_WINDOW, Window: 60, Limit: 10, TrustWeight: 1 }
+
+	now := TT.CLOCK.Now().UnixNano()
+
+	trusted := Capacity(g,"admission check trusted",0.95,policy,now)
+	untrusted := Capacity(g,"admission check untrusted",0.05,policy,now)
+
+	fmt.Println("Admitted",trusted,"of",REQUESTS,"for the reliable promise,",untrusted,"for the unreliable one")
+
+	if trusted <= untrusted {
+		fmt.Println("FAIL: admission doesn't respond to stored reliability")
+		os.Exit(1)
+	}
+
+	fmt.Println("PASS")
+}
+
+// ***********************************************************************
+
+func Capacity(g TT.Analytics, name string, reliability float64, policy TT.AdmissionPolicy, now int64) int {
+
+	// Store a fresh history and reliability under the context name, as
+	// StampedPromiseContext_End and AssessPromiseOutcome would
+
+	ctx_name := TT.KeyName(name,0)
+	_, timeslot := TT.DoughNowt(time.Unix(0,now))
+	key := ctx_name+":"+timeslot
+
+	TT.LearnUpdateKeyValueRate(g,"BeginEndLocks",key,now,float64(time.Millisecond),"ns",0.5)
+	TT.AddKV(g,"PromiseKeeping",TT.KeyValue{ K: key, V: reliability })
+
+	stored := TT.AdmissionReliability(g,ctx_name,policy,now)
+
+	fmt.Println("Stored reliability",reliability,"for",ctx_name,"read back as",stored)
+
+	ac := TT.NewAdmissionControl()
+	admitted := 0
+
+	for i := 0; i < REQUESTS; i++ {
+
+		if TT.Admit(ac,ctx_name,policy,stored,now) {
+			admitted++
+		}
+	}
+
+	return admitted
+}
@@ -24,6 +24,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 	"TT"
 )
 
@@ -33,6 +34,8 @@ func main() {
 
 	TT.InitializeContext()
 
+	now := TT.CLOCK.Now().UnixNano()
+
 	a := 0.1
 	b := 0.2
 	c := 0.3
@@ -42,13 +45,13 @@ func main() {
 	g := 0.7
 	test := 0.0
 
-	TT.CONTEXT["a"] = 0.1
-	TT.CONTEXT["b"] = 0.2
-	TT.CONTEXT["c"] = 0.3
-	TT.CONTEXT["d"] = 0.4
-	TT.CONTEXT["e"] = 0.5
-	TT.CONTEXT["f"] = 0.6
-	TT.CONTEXT["g"] = 0.7
+	TT.ContextStoreSetValue(TT.CONTEXT,"a",0.1,now)
+	TT.ContextStoreSetValue(TT.CONTEXT,"b",0.2,now)
+	TT.ContextStoreSetValue(TT.CONTEXT,"c",0.3,now)
+	TT.ContextStoreSetValue(TT.CONTEXT,"d",0.4,now)
+	TT.ContextStoreSetValue(TT.CONTEXT,"e",0.5,now)
+	TT.ContextStoreSetValue(TT.CONTEXT,"f",0.6,now)
+	TT.ContextStoreSetValue(TT.CONTEXT,"g",0.7,now)
 	
 	str1 := "test & ( a | b)"
 	cmp1 := test * (a+b)
@@ -65,8 +68,8 @@ func main() {
 	expr3,res3 := TT.ContextEval(str3)
 	fmt.Println("3.",str3,"---->",expr3,res3,"CMP",cmp3,"\n")
 
-	str3a := "(test3a) (& ( c | d))"
-	cmp3a := (test * (c+d))
+	str3a := "(test3a) (& ( c | d))"  // & has no left operand: a syntax error
+	cmp3a := -1.0
 	expr3a,res3a := TT.ContextEval(str3a)
 	fmt.Println("4.",str3a,"---->",expr3a,res3a,"CMP",cmp3a,"\n")
 
@@ -105,6 +108,54 @@ func main() {
 	expr4e,res4e := TT.ContextEval(str4e)
 	fmt.Println("10.",str4e,"---->",expr4e,res4e,"CMP",cmp4e,"\n")
 
+	str5 := "\"my-class\" && !(a || missing)"
+	cmp5 := 0
+	TT.ContextStoreSetValue(TT.CONTEXT,"my-class",1,now)
+	expr5,res5 := TT.ContextEval(str5)
+	fmt.Println("11.",str5,"---->",expr5,res5,"CMP",cmp5,"\n")
+
+	// Compile once, evaluate many times
+
+	compiled,err := TT.CompileContext("(a|b).!c")
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	TT.ContextStoreSetValue(TT.CONTEXT,"c",0,now)
+	fmt.Println("12.",TT.ContextString(compiled.Root),"---->",TT.ContextStoreEval(TT.CONTEXT,compiled,now),"CMP",a+b,"\n")
+
+	// The same expression under each fuzzy semantics
+
+	for _,semantics := range []string{ TT.FUZZY_LEGACY, TT.FUZZY_PRODUCT, TT.FUZZY_ZADEH, TT.FUZZY_LUKASIEWICZ } {
+		expr,res := TT.ContextEvalWith("(e|f|g).!a",semantics)
+		fmt.Printf("13. %-12s %s ----> %.4f\n",semantics,expr,res)
+	}
+
+	fmt.Println()
+
+	// Time and calendar classes, on Christmas Day in Oslo
+
+	oslo,_ := time.LoadLocation("Europe/Oslo")
+	holidays := []TT.Holiday{ { Class: "christmas", Date: "12-24", Days: 3 } }
+	xmas := time.Date(2023,12,25,9,30,0,0,oslo)
+
+	fmt.Println("14. time classes",TT.DefineTimeClasses(TT.CONTEXT,xmas,oslo,holidays))
+
+	for _,str := range []string{ "Monday.Morning & !holiday", "Monday.Morning & christmas", "GMT_Hr08 & tz_cet" } {
+		expr,_ := TT.CompileContext(str)
+		fmt.Println("14.",str,"---->",TT.ContextStoreEval(TT.CONTEXT,expr,xmas.UnixNano()))
+	}
+
+	fmt.Println()
+
+	// Positioned syntax errors
+
+	for _,bad := range []string{ "", "a &", "(a | b", "a b", "a | )", "a & $b" } {
+		_,err := TT.CompileContext(bad)
+		fmt.Println(err,"\n")
+	}
 
 }
 
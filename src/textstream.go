@@ -0,0 +1,133 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Fractionate a live text stream (chat, logs) as it arrives, printing the
+// events selected from each leg as a line of JSON. No database is needed, e.g.
+//
+//     tail -f chat.log | go run textstream.go -leg 10
+//     go run textstream.go -leg 100 -topics book.txt
+//     go run textstream.go -pack language_no.json -language auto bok.txt
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"TT"
+)
+
+// ****************************************************************************
+
+type LegReport struct {
+
+	Leg    TT.PrismLeg     `json:"leg"`
+	Events []TT.PrismEvent `json:"events"`
+}
+
+// ****************************************************************************
+
+func main() {
+
+	leg := flag.Int("leg",10,"sentences per leg")
+	forget := flag.Float64("forget",TT.FORGET_FRACTION,"fraction of n-gram memory forgotten per sentence")
+	topics := flag.Bool("topics",false,"print the persistent topics at the end")
+	tokenizer := flag.String("tokenizer","","words, or cjk for text without spaces (default: the language's)")
+	language := flag.String("language","","language pack, e.g. en, zh, or auto to detect it")
+	pack := flag.String("pack","","load a language pack from a JSON file, e.g. language_no.json")
+	strokes := flag.String("strokes","","load a stroke table for the strokes work measure, e.g. chinese-strokes.in")
+	work := flag.String("work","","length, or strokes (default: the language's)")
+	segmenter := flag.String("segmenter","","punctuation, or rules (default: rules with a language)")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if *pack != "" {
+
+		if _,err := TT.LoadLanguagePack(*pack); err != nil {
+			fmt.Println("Couldn't load language pack:",err)
+			os.Exit(1)
+		}
+	}
+
+	if *strokes != "" {
+
+		if _,err := TT.LoadStrokes(*strokes); err != nil {
+			fmt.Println("Couldn't load stroke table:",err)
+			os.Exit(1)
+		}
+	}
+
+	var input io.Reader = os.Stdin
+	subject := "stdin"
+
+	switch flag.NArg() {
+
+	case 0:
+
+	case 1:
+		file, err := os.Open(flag.Arg(0))
+
+		if err != nil {
+			fmt.Println("Couldn't open stream:",err)
+			os.Exit(1)
+		}
+
+		defer file.Close()
+		input = file
+		subject = flag.Arg(0)
+
+	default:
+		usage()
+	}
+
+	fs := TT.NewFractionStream(TT.NewFractionator(TT.FractionationConfig{ LegWindow: *leg, Language: *language, Tokenizer: *tokenizer, Work: *work, Segmenter: *segmenter }),subject)
+	fs.Forget = *forget
+
+	out := json.NewEncoder(os.Stdout)
+
+	err := TT.StreamReader(fs,input,func(leg TT.PrismLeg, events []TT.PrismEvent) {
+		out.Encode(LegReport{ Leg: leg, Events: events })
+	})
+
+	if err != nil {
+		fmt.Println("Stream failed:",err)
+		os.Exit(1)
+	}
+
+	if *topics {
+
+		invariants := TT.StreamTopics(fs)
+
+		for n := 1; n < TT.MAXCLUSTERS; n++ {
+			for ngram,intent := range invariants[n] {
+				fmt.Printf("topic %d \"%s\" %f\n",n,ngram,intent)
+			}
+		}
+	}
+}
+
+// ****************************************************************************
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "usage: go run textstream.go [-leg n] [-forget fraction] [-language name|auto] [-pack file] [-tokenizer words|cjk] [-strokes file] [-work length|strokes] [-segmenter punctuation|rules] [-topics] [file]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
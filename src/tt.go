@@ -0,0 +1,197 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Administrative commands for the TT library, e.g.
+//
+//     go run tt.go locks                   # list service locks
+//     go run tt.go locks -clean            # break stale locks, forget old markers
+//     go run tt.go locks -force name ...   # expire the named locks regardless
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+	"TT"
+)
+
+const (
+	POLICYFILE = "promise_policy.json"
+)
+
+// ****************************************************************************
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+
+	case "locks":
+		Locks(os.Args[2:])
+
+	default:
+		usage()
+	}
+}
+
+// ****************************************************************************
+
+func Locks(args []string) {
+
+	flags := flag.NewFlagSet("locks",flag.ExitOnError)
+
+	clean := flags.Bool("clean",false,"break stale locks and forget markers that no longer restrict anything")
+	force := flags.Bool("force",false,"expire running locks even if not stale (the named ones, or all)")
+	dir := flags.String("dir","","lock directory (default "+TT.LOCKDIR+", or "+TT.LEGACY_LOCKDIR+" with -legacy)")
+	legacy := flags.Bool("legacy",false,"old style lock.* and last.* files, e.g. left in /tmp; only our own, named ones are cleaned")
+	policyfile := flags.String("policy",POLICYFILE,"promise policy file, for ifelapsed/expireafter")
+
+	flags.Parse(args)
+	names := flags.Args()
+
+	// The legacy layout is only read and tidied, never locked through
+
+	var locker TT.LockLister
+
+	if *legacy {
+
+		if *dir == "" {
+			*dir = TT.LEGACY_LOCKDIR
+		}
+
+		locker = TT.LegacyLockDir{ Dir: *dir }
+
+	} else {
+
+		if *dir != "" {
+			TT.LOCKDIR = *dir
+		}
+
+		*dir = TT.LOCKDIR
+
+		l, err := TT.GetLocker()
+
+		if err != nil {
+			fmt.Println("Couldn't open locks:",err,"(use -legacy for a shared directory like /tmp)")
+			os.Exit(1)
+		}
+
+		locker = l
+	}
+
+	_,err := TT.LoadPromisePolicy(*policyfile)
+
+	if err != nil {
+		fmt.Println("Using default promise policy:",err)
+	}
+
+	now := TT.CLOCK.Now().UnixNano()
+
+	if *clean || *force {
+
+		done, err := TT.CleanLocksIn(locker,now,*force,names)
+
+		if err != nil {
+			fmt.Println("Couldn't clean locks:",err)
+			os.Exit(1)
+		}
+
+		for _,c := range done {
+
+			if c.Error != nil {
+				fmt.Println(" failed to clean",c.Name,c.Error)
+			} else {
+				fmt.Println(" ",c.Action,c.Name)
+			}
+		}
+
+		fmt.Println()
+	}
+
+	list, err := TT.ListLocksIn(locker,now)
+
+	if err != nil {
+		fmt.Println("Couldn't list locks:",err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Locks in",*dir)
+	fmt.Printf("\n %-40s %-8s %-24s %12s %12s %12s  %s\n","name","state","owner","running","since last","ifel/expire","status")
+
+	for _,s := range list {
+
+		state := "idle"
+		owner := "-"
+		running := "-"
+		since := "never"
+		status := "ok"
+
+		if s.Running {
+			state = "running"
+			running = Duration(s.RunningFor)
+
+			// Old style locks have no owner
+
+			if s.Holder.PID != 0 {
+
+				owner = fmt.Sprintf("%d@%s",s.Holder.PID,s.Holder.Host)
+
+				if !s.OwnerAlive {
+					owner += " (gone)"
+				}
+			}
+		}
+
+		if s.SinceLast >= 0 {
+			since = Duration(s.SinceLast)
+		}
+
+		switch {
+		case s.Foreign:
+			status = "another user's, left alone"
+		case s.Stale && s.Expired:
+			status = "stale, expired"
+		case s.Stale:
+			status = "stale, owner gone"
+		case s.TooSoon:
+			status = "too soon to run again"
+		}
+
+		fmt.Printf(" %-40s %-8s %-24s %12s %12s %12s  %s\n",s.Name,state,owner,running,since,fmt.Sprintf("%d/%d",s.IfElapsed,s.ExpireAfter),status)
+	}
+}
+
+// ****************************************************************************
+
+func Duration(seconds float64) string {
+
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// ****************************************************************************
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "usage: go run tt.go locks [-clean] [-force] [-legacy] [-dir directory] [-policy file] [name ...]\n")
+	fmt.Fprintf(os.Stderr, "       -legacy lists the old lock.* and last.* files in /tmp (or -dir), and cleans only our own, by name\n")
+	os.Exit(2)
+}
@@ -134,33 +134,33 @@ func AnalyzeTopic(subject string) int {
 	// Pure output analysis of the article
 	// ***********************************************************
 
-	TT.LEG_WINDOW = 100           // Standard for narrative text
-	TT.LEG_SELECTIONS = make([]string,0)
+	// Both analyses learn into the same n-gram memory (TT.STM_NGRAM_RANK)
+
+	article := TT.NewFractionatorWithMemory(TT.FractionationConfig{ LegWindow: 100 },TT.STM_NGRAM_RANK) // Standard for narrative text
 
 	mainpage := MainPage(page_url)
 	
 	textlength := len(mainpage)
 
-	selected,ltm := TT.FractionateSentences(mainpage)
+	selected,ltm := TT.FractionatorSentences(article,mainpage)
 
 	TT.Println("*********************************************")
 	TT.Println("* Mainpage for",subject,"-- length",textlength,"chars")
 	TT.Println("* Sentences",len(selected))
-	TT.Println("* Legs",float64(len(selected))/float64(TT.LEG_WINDOW))
+	TT.Println("* Legs",float64(len(selected))/float64(article.Config.LegWindow))
 	TT.Println("*********************************************")
 
-	TT.ReviewAndSelectEvents(subject,selected)		
+	TT.FractionatorReviewAndSelectEvents(article,subject,selected)		
 
-	pagetopics := TT.RankByIntent(selected,ltm)
+	pagetopics := TT.FractionatorRankByIntent(article,selected,ltm)
 
-	LinkPersistentToSubject(subject,pagetopics)
+	LinkPersistentToSubject(subject,article.Selections,pagetopics)
 
 	// ***********************************************************
 	// Pure output analysis of the editing history
 	// ***********************************************************
 
-	TT.LEG_WINDOW = 10 // Need a smaller window than normal for fragmented text
-	TT.LEG_SELECTIONS = make([]string,0)
+	history := TT.NewFractionatorWithMemory(TT.FractionationConfig{ LegWindow: 10 },TT.STM_NGRAM_RANK) // Need a smaller window than normal for fragmented text
 
 	changelog := HistoryPage(log_url)
 
@@ -176,20 +176,20 @@ func AnalyzeTopic(subject string) int {
 
 	talklength := len(historypage)
 
-	remarks,ltm2 := TT.FractionateSentences(historypage)
+	remarks,ltm2 := TT.FractionatorSentences(history,historypage)
 
 	TT.Println("*********************************************")
 	TT.Println("* Historypage length",subject,talklength)
 	TT.Println("* Sentences",len(remarks))
-	TT.Println("* Legs",float64(len(remarks))/float64(TT.LEG_WINDOW))
+	TT.Println("* Legs",float64(len(remarks))/float64(history.Config.LegWindow))
 	TT.Println("* Total users involved in shared process", history_users)
 	TT.Println("* Change episodes with discernable punctuation", episodes)
 	TT.Println("* The average time between changes is",avt/float64(MINUTE),"mins",avt/float64(DAY),"days")
 	TT.Println("*********************************************")
 	
-	TT.ReviewAndSelectEvents(subject + " edit history",remarks)		
+	TT.FractionatorReviewAndSelectEvents(history,subject + " edit history",remarks)		
 	
-	topics := TT.RankByIntent(remarks,ltm2)
+	topics := TT.FractionatorRankByIntent(history,remarks,ltm2)
 	
 	TT.LongitudinalPersistentConcepts(topics)
 
@@ -1179,7 +1179,7 @@ return false
 
 // **************************************************************************
 
-func LinkPersistentToSubject(subject string, concepts map[string]float64) {
+func LinkPersistentToSubject(subject string, selections []string, concepts map[string]float64) {
 
 	var count int = 0
 
@@ -1189,9 +1189,9 @@ func LinkPersistentToSubject(subject string, concepts map[string]float64) {
 
 	var last TT.Node = n_from
 
-	fmt.Println(" - adding story selections x",len(TT.LEG_SELECTIONS))
+	fmt.Println(" - adding story selections x",len(selections))
 
-	for event := range TT.LEG_SELECTIONS {
+	for event := range selections {
 
 		count++
 
@@ -1201,12 +1201,12 @@ func LinkPersistentToSubject(subject string, concepts map[string]float64) {
 			continue
 		}
 
-		this := TT.CreateNode(G,"event",key,TT.LEG_SELECTIONS[event],0,0,0,0)
+		this := TT.CreateNode(G,"event",key,selections[event],0,0,0,0)
 
 		TT.CreateLink(G, last,"LEADS_TO", this, 0)
 		//Connect the concept to the episode it occurred in
 
-		LinkAllNgramsFromTo(TT.LEG_SELECTIONS[event],this)
+		LinkAllNgramsFromTo(selections[event],this)
 
 		last = this
 	}
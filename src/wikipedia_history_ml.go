@@ -55,6 +55,8 @@ type WikiProcess struct {       // A list of all edit events
 
 const DAY = float64(3600 * 24 * TT.NANO)
 const MINUTE = float64(60 * TT.NANO)
+const RULEFILE = "episode_rules.json"
+const POLICYFILE = "promise_policy.json"
 
 var G TT.Analytics
 var ARTICLE_ISSUES int = 0
@@ -105,6 +107,22 @@ func main() {
 
 	G = TT.OpenAnalytics(dbname,dburl,user,pwd)
 
+	// Rules that act on the contexts of each episode
+
+	_,err := TT.LoadRules(RULEFILE)
+
+	if err != nil {
+		fmt.Println("No episode rules:",err)
+	}
+
+	// How long an editing episode is promised to take, and how often we look
+
+	_,err = TT.LoadPromisePolicy(POLICYFILE)
+
+	if err != nil {
+		fmt.Println("Using default promise policy:",err)
+	}
+
 	// Load any pretraining
 
 	for n := 1; n < TT.MAXCLUSTERS; n++ {
@@ -210,7 +228,7 @@ func AnalyzeTopicContext(subject string) [TT.MAXCLUSTERS]map[string]float64 {
 
 	const paragraph_radius = 100
 
-	return TT.TextPrism(subject, mainpage, paragraph_radius)
+	return TT.TextPrism(subject, mainpage, paragraph_radius).Ngrams
 }
 
 // ***********************************************************
@@ -694,8 +712,9 @@ func HistoryAssessment(subject string, changelog []WikiProcess, ngram_ctx [TT.MA
 
 	burststart = changelog[0].Date.UnixNano()
 
-	// Set name to null string to collapse all subjects into (n)one
-	name := ""
+	// One name collapses all subjects into one promise, which the episode
+	// rules adjust and sample by name
+	name := "wikipedia"
 
 	ctx := TT.StampedPromiseContext_Begin(G, name, changelog[0].Date)
 
@@ -772,14 +791,27 @@ func HistoryAssessment(subject string, changelog []WikiProcess, ngram_ctx [TT.MA
 
 			// Checks
 
+			quality := TT.ASSESS_PAR
+
 			if sum_burst_bytes != 0 {
-				trust_level := AssessChanges(add,rm,cumulative_message,episode_len,edit_balance/sum_burst_bytes,burst_duration)
+				var trust_level string
+				trust_level,quality = AssessChanges(add,rm,cumulative_message,episode_len,edit_balance/sum_burst_bytes,burst_duration)
 				TT.ContextAdd(trust_level)
 			}	
 
 			fmt.Println("CONTEXT tick",TT.ContextSet())
 
-			TT.StampedPromiseContext_End(G, ctx,changelog[i].Date)
+			episode_key := fmt.Sprintf("%s_%d",subject,episode)
+
+			TT.EvaluateRules(G,TT.RULES,TT.CONTEXT,episode_key,changelog[i].Date.UnixNano())
+
+			e := TT.StampedPromiseContext_End(G, ctx,changelog[i].Date)
+
+			TT.AssessPromiseByPolicy(G,e,quality)
+
+			// Keep the context of this episode for later learning
+
+			TT.SaveEpisodeContext(G,episode_key,TT.CONTEXT,changelog[i].Date.UnixNano())
 
 			if i+1 < len(changelog) {
 				ctx = TT.StampedPromiseContext_Begin(G, name, changelog[i+1].Date)
@@ -813,7 +845,7 @@ func IsAnonymous(user string) bool {
 
 // *******************************************************************************
 
-func AssessChanges(add,rm,message string, eplen int, align,duration float64) string {
+func AssessChanges(add,rm,message string, eplen int, align,duration float64) (string,float64) {
 
 	add_len := len(add)
 	rm_len := len(rm)
@@ -907,7 +939,7 @@ func AssessChanges(add,rm,message string, eplen int, align,duration float64) str
 		}
 	}
 
-	return assess_s
+	return assess_s,assess
 }
 
 // *******************************************************************************